@@ -3,6 +3,9 @@ package cmd
 import (
 	"fmt"
 	exporter "github.com/bostrt/vsphere-ci-session-metrics/pkg/exporter"
+	"github.com/bostrt/vsphere-ci-session-metrics/pkg/service/build"
+	"github.com/bostrt/vsphere-ci-session-metrics/pkg/service/kube"
+	"github.com/bostrt/vsphere-ci-session-metrics/pkg/service/prow"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -13,6 +16,7 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 )
@@ -32,46 +36,157 @@ var startCmd = &cobra.Command{
 		}
 		log.SetLevel(level)
 
-		// Validate build cluster kubeconfig file
-		kcPath := viper.GetString("build-kubeconfig")
-		log.Tracef("validating build cluster kubeconfig path: %s", kcPath)
-		_, err = os.Stat(kcPath)
+		// Gather how to reach the build clusters from the flags and the
+		// config file
+		buildAuth := kube.AuthConfig{
+			Kubeconfig: viper.GetString("build-kubeconfig"),
+			Context:    viper.GetString("build-context"),
+			InCluster:  viper.GetBool("build-in-cluster"),
+			TokenFile:  viper.GetString("build-token-file"),
+		}
+		var buildClusters []exporter.BuildCluster
+		err = viper.UnmarshalKey("build-clusters", &buildClusters)
 		if err != nil {
-			log.Error(errors.Wrap(err, "error finding build kubeconfig"))
+			log.Error(errors.Wrap(err, "error parsing build clusters from config"))
+			return
+		}
+		if !buildAuth.Configured() && len(buildClusters) == 0 {
+			log.Error("no build clusters configured, use --build-kubeconfig, --build-in-cluster or list build-clusters in the config file")
+			return
+		}
+		if buildAuth.InCluster && buildAuth.Kubeconfig != "" {
+			log.Error("--build-in-cluster and --build-kubeconfig can't be used together")
 			return
 		}
-		log.Debugf("build cluster kubeconfig path: %s", kcPath)
 
-		// Validate prow kubeconfig file
-		pkcPath := viper.GetString("prow-kubeconfig")
-		log.Tracef("validating prow kubeconfig path: %s", pkcPath)
-		if pkcPath != "" {
-			_, err = os.Stat(pkcPath)
+		// Files that must exist, and what they are for
+		files := map[string]string{}
+		if buildAuth.Kubeconfig != "" {
+			files[buildAuth.Kubeconfig] = "build kubeconfig"
+		}
+		if buildAuth.TokenFile != "" {
+			files[buildAuth.TokenFile] = "build token file"
+		}
+		for _, bc := range buildClusters {
+			if bc.Name == "" {
+				log.Error("build cluster without a name in config")
+				return
+			}
+			if bc.InCluster && bc.Kubeconfig != "" {
+				log.Errorf("build cluster %s can't have both a kubeconfig and in-cluster set", bc.Name)
+				return
+			}
+			if bc.Kubeconfig == "" && !bc.InCluster && !buildAuth.Configured() {
+				log.Errorf("build cluster %s has no kubeconfig and neither --build-kubeconfig nor --build-in-cluster is set", bc.Name)
+				return
+			}
+			if bc.Kubeconfig != "" {
+				files[bc.Kubeconfig] = "build kubeconfig"
+			}
+			if bc.TokenFile != "" {
+				files[bc.TokenFile] = "build token file"
+			}
+		}
+
+		// Prow is queried anonymously unless told how to reach its cluster
+		prowAuth := kube.AuthConfig{
+			Kubeconfig: viper.GetString("prow-kubeconfig"),
+			Context:    viper.GetString("prow-context"),
+			InCluster:  viper.GetBool("prow-in-cluster"),
+			TokenFile:  viper.GetString("prow-token-file"),
+		}
+		if prowAuth.InCluster && prowAuth.Kubeconfig != "" {
+			log.Error("--prow-in-cluster and --prow-kubeconfig can't be used together")
+			return
+		}
+		if !prowAuth.Configured() && (prowAuth.Context != "" || prowAuth.TokenFile != "") {
+			log.Error("--prow-context and --prow-token-file require --prow-kubeconfig or --prow-in-cluster")
+			return
+		}
+		if !prowAuth.Configured() && viper.GetBool("prow-informer") {
+			log.Error("--prow-informer requires --prow-kubeconfig or --prow-in-cluster")
+			return
+		}
+		if prowAuth.Kubeconfig != "" {
+			files[prowAuth.Kubeconfig] = "prow kubeconfig"
+		}
+		if prowAuth.TokenFile != "" {
+			files[prowAuth.TokenFile] = "prow token file"
+		}
+
+		for path, kind := range files {
+			log.Tracef("validating %s path: %s", kind, path)
+			_, err = os.Stat(path)
 			if err != nil {
-				log.Error(errors.Wrap(err, "error finding prow kubeconfig"))
+				log.Error(errors.Wrapf(err, "error finding %s", kind))
 				return
 			}
-			log.Debugf("prow kubeconfig path: %s", pkcPath)
+			log.Debugf("%s path: %s", kind, path)
+		}
+
+		// Unless told otherwise, select the jobs each way of querying Prow
+		// always selected
+		clusterAliases := viper.GetStringSlice("prow-cluster-aliases")
+		labelSelector := viper.GetString("prow-label-selector")
+		if !viper.IsSet("prow-cluster-aliases") && !viper.IsSet("prow-label-selector") {
+			defaultSelector := prow.DefaultSelectorConfig(prowAuth.Configured())
+			clusterAliases = defaultSelector.ClusterAliases
+			labelSelector = defaultSelector.LabelSelector
 		}
 
-		// Validate vSphere hostname
-		vsphereHost := viper.GetString("vsphere")
-		log.Tracef("validating vsphere hostname: %s", vsphereHost)
-		addrs, err := net.LookupHost(vsphereHost)
+		// Gather vCenters from the config file and flags
+		var vcenters []exporter.VCenter
+		err = viper.UnmarshalKey("vcenters", &vcenters)
 		if err != nil {
-			log.Error(err)
+			log.Error(errors.Wrap(err, "error parsing vcenters from config"))
 			return
 		}
-		if len(addrs) == 0 {
-			log.Errorf("no addresses found: %s", vsphereHost)
+		if vsphereHost := viper.GetString("vsphere"); vsphereHost != "" {
+			vcenters = append(vcenters, exporter.VCenter{
+				Host:     vsphereHost,
+				User:     viper.GetString("vsphere-user"),
+				Password: viper.GetString("vsphere-passwd"),
+			})
+		}
+		if len(vcenters) == 0 {
+			log.Error("no vCenters configured, use --vsphere or list vcenters in the config file")
 			return
 		}
-		log.Debugf("vsphere hostname: %s", vsphereHost)
-		
-		// Validate Prow hostname
-		prowHost := viper.GetString("prow")
+
+		// Validate vSphere hostnames
+		for i := range vcenters {
+			vc := &vcenters[i]
+			log.Tracef("validating vsphere hostname: %s", vc.Host)
+			addrs, err := net.LookupHost(vc.Host)
+			if err != nil {
+				log.Error(err)
+				return
+			}
+			if len(addrs) == 0 {
+				log.Errorf("no addresses found: %s", vc.Host)
+				return
+			}
+			if vc.User == "" || vc.Password == "" {
+				log.Errorf("missing user or password for vsphere: %s", vc.Host)
+				return
+			}
+			if vc.UserAgent == "" {
+				vc.UserAgent = viper.GetString("vsphere-user-agent")
+			}
+			log.Debugf("vsphere hostname: %s", vc.Host)
+		}
+
+
+		// Validate Prow URL and hostname
+		prowURI := viper.GetString("prow")
+		prowURL, err := prow.ParseBaseURL(prowURI)
+		if err != nil {
+			log.Error(err)
+			return
+		}
+		prowHost := prowURL.Hostname()
 		log.Tracef("validating prow hostname: %s", prowHost)
-		addrs, err = net.LookupHost(prowHost)
+		addrs, err := net.LookupHost(prowHost)
 		if err != nil {
 			log.Error(err)
 			return
@@ -84,20 +199,53 @@ var startCmd = &cobra.Command{
 
 
 		// Get rest of flags
-		vsphereUser := viper.GetString("vsphere-user")
-		vspherePasswd := viper.GetString("vsphere-passwd")
-		vsphereUserAgent := viper.GetString("vsphere-user-agent")
-		prow := viper.GetString("prow")
 		listen := viper.GetInt("listen-port")
 		warning := viper.GetFloat64("warning-threshold")
+		refreshInterval := viper.GetDuration("refresh-interval")
+		if refreshInterval <= 0 {
+			log.Errorf("refresh interval must be positive: %s", refreshInterval)
+			return
+		}
 
 		// Set up the exporter
-		exporter, err := exporter.NewExporter(warning, kcPath, pkcPath, vsphereHost, vsphereUser, vspherePasswd, vsphereUserAgent, prow)
-		defer exporter.Shutdown()
+		exporter, err := exporter.NewExporter(exporter.Config{
+			WarningThreshold:           warning,
+			RefreshInterval:            refreshInterval,
+			IdleThreshold:              viper.GetDuration("idle-threshold"),
+			PostJobGrace:               viper.GetDuration("post-job-grace"),
+			BuildAuth:                  buildAuth,
+			BuildClusters:              buildClusters,
+			BuildIDLabel:               viper.GetString("build-id-label"),
+			BuildLogContainer:          viper.GetString("build-log-container"),
+			BuildLogLimitBytes:         viper.GetInt64("build-log-limit-bytes"),
+			NamespaceRegex:             viper.GetString("namespace-regex"),
+			ResolutionCacheTTL:         viper.GetDuration("resolution-cache-ttl"),
+			ResolutionNegativeCacheTTL: viper.GetDuration("resolution-negative-cache-ttl"),
+			ProwAuth:                   prowAuth,
+			ProwInformer:               viper.GetBool("prow-informer"),
+			ProwURI:                    prowURI,
+			ProwCAFile:                 viper.GetString("prow-ca-file"),
+			ProwTimeout:                viper.GetDuration("prow-timeout"),
+			ProwSelector: prow.SelectorConfig{
+				ClusterAliases: clusterAliases,
+				LabelSelector:  labelSelector,
+				States:         viper.GetStringSlice("prow-job-states"),
+				IncludeJobs:    viper.GetStringSlice("prow-include-jobs"),
+				ExcludeJobs:    viper.GetStringSlice("prow-exclude-jobs"),
+				JobTypes:       viper.GetStringSlice("prow-job-types"),
+				MaxFinishedAge: viper.GetDuration("prow-max-finished-age"),
+			},
+			CorrelatedLabels: viper.GetStringSlice("correlated-labels"),
+			JobInfoMetric:    viper.GetBool("job-info-metric"),
+			VCenters:         vcenters,
+			CIVCenters:       viper.GetStringSlice("ci-vcenters"),
+		})
 		if err != nil {
 			log.Error(err)
 			return
 		}
+		exporter.Start()
+		defer exporter.Shutdown()
 
 		// Launch the server
 		prometheus.MustRegister(exporter)
@@ -117,40 +265,125 @@ func init() {
 		presetRequiredFlags(startCmd)
 	})
 
-	startCmd.Flags().Float64("warning-threshold", 30, "print a warning when scrapes take more than this many seconds")
+	startCmd.Flags().Float64("warning-threshold", 30, "print a warning when refreshes take more than this many seconds")
 	viper.BindPFlag("warning-threshold", startCmd.Flags().Lookup("warning-threshold"))
 
+	startCmd.Flags().Duration("refresh-interval", time.Minute, "how often data is gathered from vSphere, Prow and the build cluster")
+	viper.BindPFlag("refresh-interval", startCmd.Flags().Lookup("refresh-interval"))
+
+	startCmd.Flags().Duration("idle-threshold", 30*time.Minute, "sessions idle for longer than this are counted as idle")
+	viper.BindPFlag("idle-threshold", startCmd.Flags().Lookup("idle-threshold"))
+
+	startCmd.Flags().Duration("post-job-grace", time.Hour, "how long the CI user of a finished Prow job is watched for sessions left behind")
+	viper.BindPFlag("post-job-grace", startCmd.Flags().Lookup("post-job-grace"))
+
+	startCmd.Flags().StringSlice("correlated-labels", nil, "extra labels for the correlated metric: org, repo, base_ref, pull_number, pull_author, job_type, cluster_alias, target, variant, job_url")
+	viper.BindPFlag("correlated-labels", startCmd.Flags().Lookup("correlated-labels"))
+
+	startCmd.Flags().Bool("job-info-metric", false, "export vsphere_ci_job_info with the datacenter, cluster, datastore and network each running job uses")
+	viper.BindPFlag("job-info-metric", startCmd.Flags().Lookup("job-info-metric"))
+
 	startCmd.Flags().Int("listen-port", 8090, "exporter will listen on this port")
 	viper.BindPFlag("listen-port", startCmd.Flags().Lookup("listen-port"))
 
 	startCmd.Flags().String("log-level", "info", "set log level (e.g. debug, warn, error)")
 	viper.BindPFlag("log-level", startCmd.Flags().Lookup("log-level"))
 
-	startCmd.Flags().String("build-kubeconfig", "", "path to build cluster kubeconfig")
+	startCmd.Flags().String("build-kubeconfig", "", "path to build cluster kubeconfig, unless build-clusters in the config file all have their own")
 	startCmd.MarkFlagFilename("build-kubeconfig")
-	startCmd.MarkFlagRequired("build-kubeconfig")
 	viper.BindPFlag("build-kubeconfig", startCmd.Flags().Lookup("build-kubeconfig"))
 
+	startCmd.Flags().String("build-context", "", "build cluster kubeconfig context (default is the current context)")
+	viper.BindPFlag("build-context", startCmd.Flags().Lookup("build-context"))
+
+	startCmd.Flags().Bool("build-in-cluster", false, "reach the build cluster with the service account of the pod the exporter runs in")
+	viper.BindPFlag("build-in-cluster", startCmd.Flags().Lookup("build-in-cluster"))
+
+	startCmd.Flags().String("build-token-file", "", "path to a bearer token for the build cluster, re-read every minute, used instead of the kubeconfig's credentials")
+	startCmd.MarkFlagFilename("build-token-file")
+	viper.BindPFlag("build-token-file", startCmd.Flags().Lookup("build-token-file"))
+
+	startCmd.Flags().String("build-id-label", build.DefaultBuildIDLabel, "label ci-operator puts the build ID of a job in on the pods in its namespace")
+	viper.BindPFlag("build-id-label", startCmd.Flags().Lookup("build-id-label"))
+
+	startCmd.Flags().String("build-log-container", build.DefaultLogContainer, "container of the job pod whose log the ci-op namespace is read from")
+	viper.BindPFlag("build-log-container", startCmd.Flags().Lookup("build-log-container"))
+
+	startCmd.Flags().Int64("build-log-limit-bytes", build.DefaultLogLimitBytes, "most bytes of the job pod log read looking for the ci-op namespace")
+	viper.BindPFlag("build-log-limit-bytes", startCmd.Flags().Lookup("build-log-limit-bytes"))
+
+	startCmd.Flags().String("namespace-regex", build.UsingNamespaceRegex.String(), "regex finding the ci-op namespace in the job pod log, the first submatch is the namespace")
+	viper.BindPFlag("namespace-regex", startCmd.Flags().Lookup("namespace-regex"))
+
+	startCmd.Flags().Duration("resolution-cache-ttl", time.Hour, "how long the CI users of a running job are cached (0 to disable)")
+	viper.BindPFlag("resolution-cache-ttl", startCmd.Flags().Lookup("resolution-cache-ttl"))
+
+	startCmd.Flags().Duration("resolution-negative-cache-ttl", 5*time.Minute, "how long a job whose CI users couldn't be found is left alone (0 to disable)")
+	viper.BindPFlag("resolution-negative-cache-ttl", startCmd.Flags().Lookup("resolution-negative-cache-ttl"))
+
 	startCmd.Flags().String("prow-kubeconfig", "", "path to prow kubeconfig")
 	viper.BindPFlag("prow-kubeconfig", startCmd.Flags().Lookup("prow-kubeconfig"))
 
-	startCmd.Flags().String("vsphere", "", "vSphere hostname (do not include scheme)")
-	startCmd.MarkFlagRequired("vsphere")
+	startCmd.Flags().String("prow-context", "", "prow kubeconfig context (default is the current context)")
+	viper.BindPFlag("prow-context", startCmd.Flags().Lookup("prow-context"))
+
+	startCmd.Flags().Bool("prow-in-cluster", false, "reach the Prow cluster with the service account of the pod the exporter runs in")
+	viper.BindPFlag("prow-in-cluster", startCmd.Flags().Lookup("prow-in-cluster"))
+
+	startCmd.Flags().String("prow-token-file", "", "path to a bearer token for the Prow cluster, re-read every minute, used instead of the kubeconfig's credentials")
+	startCmd.MarkFlagFilename("prow-token-file")
+	viper.BindPFlag("prow-token-file", startCmd.Flags().Lookup("prow-token-file"))
+
+	startCmd.Flags().Bool("prow-informer", false, "watch ProwJobs and serve them from a local cache (requires --prow-kubeconfig or --prow-in-cluster)")
+	viper.BindPFlag("prow-informer", startCmd.Flags().Lookup("prow-informer"))
+
+	startCmd.Flags().String("vsphere", "", "vSphere hostname (do not include scheme), in addition to vcenters in the config file")
 	viper.BindPFlag("vsphere", startCmd.Flags().Lookup("vsphere"))
 
 	startCmd.Flags().String("vsphere-user", "", "username for vSphere")
-	startCmd.MarkFlagRequired("vsphere-user")
 	viper.BindPFlag("vsphere-user", startCmd.Flags().Lookup("vsphere-user"))
 
 	startCmd.Flags().String("vsphere-passwd", "", "password for vSphere")
-	startCmd.MarkFlagRequired("vsphere-passwd")
 	viper.BindPFlag("vsphere-passwd", startCmd.Flags().Lookup("vsphere-passwd"))
 
-	startCmd.Flags().String("vsphere-user-agent", "vsphere-ci-session-metrics", "user agent to vSphere communication")
+	startCmd.Flags().String("vsphere-user-agent", "vsphere-ci-session-metrics", "user agent to vSphere communication, unless set per vCenter in the config file")
 	viper.BindPFlag("vsphere-user-agent", startCmd.Flags().Lookup("vsphere-user-agent"))
 
-	startCmd.Flags().String("prow", "prow.ci.openshift.org", "URL for Prow CI instance")
+	startCmd.Flags().StringSlice("ci-vcenters", nil, "vCenters to accept CI jobs for (default is every monitored vCenter)")
+	viper.BindPFlag("ci-vcenters", startCmd.Flags().Lookup("ci-vcenters"))
+
+	startCmd.Flags().String("prow", "prow.ci.openshift.org", "URL for Prow CI instance (scheme defaults to https, may include a path prefix)")
 	viper.BindPFlag("prow", startCmd.Flags().Lookup("prow"))
+
+	startCmd.Flags().String("prow-ca-file", "", "path to a PEM bundle of extra CAs to trust for Prow")
+	startCmd.MarkFlagFilename("prow-ca-file")
+	viper.BindPFlag("prow-ca-file", startCmd.Flags().Lookup("prow-ca-file"))
+
+	startCmd.Flags().Duration("prow-timeout", 30*time.Second, "timeout for requests to Prow")
+	viper.BindPFlag("prow-timeout", startCmd.Flags().Lookup("prow-timeout"))
+
+	defaultSelector := prow.DefaultSelectorConfig(false)
+
+	startCmd.Flags().StringSlice("prow-cluster-aliases", nil, "only select Prow jobs running on these build cluster aliases (empty for any) (default vsphere when Prow is queried anonymously)")
+	viper.BindPFlag("prow-cluster-aliases", startCmd.Flags().Lookup("prow-cluster-aliases"))
+
+	startCmd.Flags().String("prow-label-selector", "", "only select Prow jobs matching this label selector (default \""+prow.VSphereLabelSelector+"\" when Prow is queried with --prow-kubeconfig or --prow-in-cluster)")
+	viper.BindPFlag("prow-label-selector", startCmd.Flags().Lookup("prow-label-selector"))
+
+	startCmd.Flags().StringSlice("prow-job-states", defaultSelector.States, "only select Prow jobs in these states (empty for any)")
+	viper.BindPFlag("prow-job-states", startCmd.Flags().Lookup("prow-job-states"))
+
+	startCmd.Flags().StringArray("prow-include-jobs", nil, "only select Prow jobs whose name matches one of these regexes (repeatable)")
+	viper.BindPFlag("prow-include-jobs", startCmd.Flags().Lookup("prow-include-jobs"))
+
+	startCmd.Flags().StringArray("prow-exclude-jobs", nil, "never select Prow jobs whose name matches one of these regexes (repeatable)")
+	viper.BindPFlag("prow-exclude-jobs", startCmd.Flags().Lookup("prow-exclude-jobs"))
+
+	startCmd.Flags().StringSlice("prow-job-types", nil, "only select these types of Prow jobs, e.g. presubmit or periodic (default any)")
+	viper.BindPFlag("prow-job-types", startCmd.Flags().Lookup("prow-job-types"))
+
+	startCmd.Flags().Duration("prow-max-finished-age", defaultSelector.MaxFinishedAge, "only select finished Prow jobs that finished this recently")
+	viper.BindPFlag("prow-max-finished-age", startCmd.Flags().Lookup("prow-max-finished-age"))
 }
 
 func presetRequiredFlags(cmd *cobra.Command) {
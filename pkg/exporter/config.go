@@ -0,0 +1,84 @@
+package exporter
+
+import (
+	"time"
+
+	"github.com/bostrt/vsphere-ci-session-metrics/pkg/service/kube"
+	"github.com/bostrt/vsphere-ci-session-metrics/pkg/service/prow"
+)
+
+// Config holds everything needed to set up an Exporter.
+type Config struct {
+	WarningThreshold float64
+	RefreshInterval  time.Duration
+	IdleThreshold    time.Duration
+	PostJobGrace     time.Duration // How long sessions are watched after a job finishes
+	BuildAuth        kube.AuthConfig
+	BuildClusters    []BuildCluster // Defaults to BuildAuth for every job
+	BuildIDLabel     string         // Label ci-operator puts the build ID in, see build.ResolverConfig
+
+	// Where the ci-op-* namespace is looked for in job pod logs, see
+	// build.ResolverConfig. NamespaceRegex must have a submatch for the
+	// namespace.
+	BuildLogContainer  string
+	BuildLogLimitBytes int64
+	NamespaceRegex     string
+
+	// How long the CI users of jobs, or the failure to find them, are cached
+	ResolutionCacheTTL         time.Duration
+	ResolutionNegativeCacheTTL time.Duration
+
+	ProwAuth         kube.AuthConfig // Prow is queried anonymously unless configured
+	ProwInformer     bool            // Watch ProwJobs instead of listing them, needs ProwAuth
+	ProwURI          string          // Base URL, or just the hostname
+	ProwCAFile       string
+	ProwTimeout      time.Duration
+	ProwSelector     prow.SelectorConfig // Which ProwJobs are correlated
+	CorrelatedLabels []string            // Opt-in labels of the correlated metric, e.g. org or job_url
+	JobInfoMetric    bool                // Export vsphere_ci_job_info
+	VCenters         []VCenter
+
+	// CIVCenters are the vCenters CI users are accepted for. Defaults to the
+	// hosts of VCenters.
+	CIVCenters []string
+}
+
+// BuildCluster is a build cluster jobs are looked up in. Name is the cluster
+// alias of the ProwJobs that run on it. Clusters with neither a Kubeconfig
+// nor InCluster use Config.BuildAuth.
+type BuildCluster struct {
+	Name       string `mapstructure:"name"`
+	Kubeconfig string `mapstructure:"kubeconfig"`
+	Context    string `mapstructure:"context"` // Defaults to the current context
+	InCluster  bool   `mapstructure:"in-cluster"`
+	TokenFile  string `mapstructure:"token-file"`
+}
+
+// auth returns how to reach the build cluster, filling in defaults.
+func (bc BuildCluster) auth(defaults kube.AuthConfig) kube.AuthConfig {
+	if bc.Kubeconfig != "" || bc.InCluster {
+		return kube.AuthConfig{
+			Kubeconfig: bc.Kubeconfig,
+			Context:    bc.Context,
+			InCluster:  bc.InCluster,
+			TokenFile:  bc.TokenFile,
+		}
+	}
+
+	auth := defaults
+	if bc.Context != "" {
+		auth.Context = bc.Context
+	}
+	if bc.TokenFile != "" {
+		auth.TokenFile = bc.TokenFile
+	}
+	return auth
+}
+
+// VCenter is a single vCenter to collect sessions from.
+type VCenter struct {
+	Host      string `mapstructure:"host"`
+	User      string `mapstructure:"user"`
+	Password  string `mapstructure:"password"`
+	UserAgent string `mapstructure:"user-agent"`
+}
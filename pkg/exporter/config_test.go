@@ -0,0 +1,39 @@
+package exporter
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+
+	"github.com/bostrt/vsphere-ci-session-metrics/pkg/service/kube"
+)
+
+func Test_BuildCluster_auth(t *testing.T) {
+	defaults := kube.AuthConfig{
+		Kubeconfig: "/etc/kubeconfigs/build",
+		Context:    "build01",
+		TokenFile:  "/var/run/secrets/build/token",
+	}
+
+	tests := []struct {
+		cluster  BuildCluster
+		expected kube.AuthConfig
+	}{
+		{BuildCluster{Name: "build01"}, defaults},
+		{
+			BuildCluster{Name: "build02", Context: "build02"},
+			kube.AuthConfig{Kubeconfig: "/etc/kubeconfigs/build", Context: "build02", TokenFile: "/var/run/secrets/build/token"},
+		},
+		{
+			BuildCluster{Name: "vsphere", Kubeconfig: "/etc/kubeconfigs/vsphere"},
+			kube.AuthConfig{Kubeconfig: "/etc/kubeconfigs/vsphere"},
+		},
+		{
+			BuildCluster{Name: "vsphere", InCluster: true, TokenFile: "/var/run/secrets/vsphere/token"},
+			kube.AuthConfig{InCluster: true, TokenFile: "/var/run/secrets/vsphere/token"},
+		},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, test.cluster.auth(defaults), test.cluster.Name)
+	}
+}
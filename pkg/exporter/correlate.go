@@ -0,0 +1,106 @@
+package exporter
+
+import (
+	"github.com/bostrt/vsphere-ci-session-metrics/pkg/service/build"
+	"github.com/bostrt/vsphere-ci-session-metrics/pkg/service/vsphere"
+)
+
+// How sessions in CorrelatedSessions were attributed to a job
+const (
+	// The job is the only one using the CI user
+	AttributionUser = "user"
+	// The session's client IP belongs to one of the job's pods
+	AttributionIP = "ip"
+	// Several jobs share the CI user and the session couldn't be told apart,
+	// so it is counted for each of them
+	AttributionAmbiguous = "ambiguous"
+)
+
+// jobUser is a running Prow job whose CI user has been resolved. Jobs with
+// several ci-operator targets can have one per target.
+type jobUser struct {
+	Job         string
+	BuildID     string
+	Target      string
+	PullRequest string
+	Username    string // Without domain
+	VCenter     string
+	IPs         map[string]bool // Pod IPs of the job, only listed for shared CI users
+	ExtraLabels []string        // Values of the opt-in correlated labels
+
+	// Where the job's pods run
+	BuildCluster string
+	Namespace    string
+
+	// Where the job installs its clusters on VCenter, from metadata.json
+	InfraID        string
+	FailureDomains []build.FailureDomain
+}
+
+// correlate attributes the sessions in v to the jobs using the sessions' CI
+// users. All jobs must use the vCenter v was gathered from.
+func correlate(jobs []jobUser, v *vsphere.VSphereUsers) []CorrelatedSessions {
+	type key struct {
+		job         int
+		userAgent   string
+		attribution string
+	}
+
+	jobsByUser := map[string][]int{}
+	for i, job := range jobs {
+		jobsByUser[job.Username] = append(jobsByUser[job.Username], i)
+	}
+
+	counts := map[key]float64{}
+	var keys []key
+	count := func(k key) {
+		if _, ok := counts[k]; !ok {
+			keys = append(keys, k)
+		}
+		counts[k]++
+	}
+
+	for _, s := range v.Sessions {
+		candidates := jobsByUser[s.Username]
+		switch len(candidates) {
+		case 0:
+			continue
+		case 1:
+			count(key{candidates[0], s.UserAgent, AttributionUser})
+			continue
+		}
+
+		var matches []int
+		for _, i := range candidates {
+			if s.IPAddress != "" && jobs[i].IPs[s.IPAddress] {
+				matches = append(matches, i)
+			}
+		}
+
+		if len(matches) == 1 {
+			count(key{matches[0], s.UserAgent, AttributionIP})
+			continue
+		}
+
+		for _, i := range candidates {
+			count(key{i, s.UserAgent, AttributionAmbiguous})
+		}
+	}
+
+	correlated := make([]CorrelatedSessions, 0, len(keys))
+	for _, k := range keys {
+		job := jobs[k.job]
+		correlated = append(correlated, CorrelatedSessions{
+			Username:    job.Username,
+			UserAgent:   k.userAgent,
+			Job:         job.Job,
+			BuildID:     job.BuildID,
+			PullRequest: job.PullRequest,
+			VCenter:     job.VCenter,
+			Attribution: k.attribution,
+			ExtraLabels: job.ExtraLabels,
+			Count:       counts[k],
+		})
+	}
+	return correlated
+}
@@ -0,0 +1,46 @@
+package exporter
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+
+	"github.com/bostrt/vsphere-ci-session-metrics/pkg/service/vsphere"
+)
+
+func Test_correlate_SingleJob(t *testing.T) {
+	jobs := []jobUser{
+		{Job: "e2e-vsphere", BuildID: "1", Username: "ci_user_01", VCenter: "vc1.example.com"},
+	}
+	v := &vsphere.VSphereUsers{
+		Sessions: []vsphere.UserSession{
+			{Username: "ci_user_01", UserAgent: "govc", IPAddress: "10.0.0.1"},
+			{Username: "ci_user_01", UserAgent: "govc", IPAddress: "10.0.0.2"},
+			{Username: "ci_user_02", UserAgent: "govc", IPAddress: "10.0.0.3"},
+		},
+	}
+
+	assert.Equal(t, []CorrelatedSessions{
+		{Username: "ci_user_01", UserAgent: "govc", Job: "e2e-vsphere", BuildID: "1", VCenter: "vc1.example.com", Attribution: AttributionUser, Count: 2},
+	}, correlate(jobs, v))
+}
+
+func Test_correlate_SharedUser(t *testing.T) {
+	jobs := []jobUser{
+		{Job: "e2e-vsphere", BuildID: "1", Username: "ci_user_01", VCenter: "vc1.example.com", IPs: map[string]bool{"10.0.0.1": true}},
+		{Job: "e2e-vsphere-upi", BuildID: "2", Username: "ci_user_01", VCenter: "vc1.example.com", IPs: map[string]bool{"10.0.0.2": true}},
+	}
+	v := &vsphere.VSphereUsers{
+		Sessions: []vsphere.UserSession{
+			{Username: "ci_user_01", UserAgent: "govc", IPAddress: "10.0.0.1"},
+			{Username: "ci_user_01", UserAgent: "terraform", IPAddress: "10.0.0.2"},
+			{Username: "ci_user_01", UserAgent: "govc", IPAddress: "192.168.0.1"},
+		},
+	}
+
+	assert.Equal(t, []CorrelatedSessions{
+		{Username: "ci_user_01", UserAgent: "govc", Job: "e2e-vsphere", BuildID: "1", VCenter: "vc1.example.com", Attribution: AttributionIP, Count: 1},
+		{Username: "ci_user_01", UserAgent: "terraform", Job: "e2e-vsphere-upi", BuildID: "2", VCenter: "vc1.example.com", Attribution: AttributionIP, Count: 1},
+		{Username: "ci_user_01", UserAgent: "govc", Job: "e2e-vsphere", BuildID: "1", VCenter: "vc1.example.com", Attribution: AttributionAmbiguous, Count: 1},
+		{Username: "ci_user_01", UserAgent: "govc", Job: "e2e-vsphere-upi", BuildID: "2", VCenter: "vc1.example.com", Attribution: AttributionAmbiguous, Count: 1},
+	}, correlate(jobs, v))
+}
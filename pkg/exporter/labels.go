@@ -0,0 +1,102 @@
+package exporter
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	prowapiv1 "k8s.io/test-infra/prow/apis/prowjobs/v1"
+
+	"github.com/bostrt/vsphere-ci-session-metrics/pkg/service/prow"
+)
+
+// Labels of vsphere_ci_user_sessions_correlated that are always there
+var correlatedMetricLabels = []string{"username", "user_agent", "ci_job", "build_id", "pull_request", "vcenter", "attribution"}
+
+// jobLabels are the opt-in labels of vsphere_ci_user_sessions_correlated, and
+// how each is taken from a ProwJob and its ci-operator target.
+var jobLabels = map[string]func(job prowapiv1.ProwJob, target string) string{
+	"org": func(job prowapiv1.ProwJob, _ string) string {
+		if refs := prow.GetRefsFromJob(job); refs != nil {
+			return refs.Org
+		}
+		return ""
+	},
+	"repo": func(job prowapiv1.ProwJob, _ string) string {
+		if refs := prow.GetRefsFromJob(job); refs != nil {
+			return refs.Repo
+		}
+		return ""
+	},
+	"base_ref": func(job prowapiv1.ProwJob, _ string) string {
+		if refs := prow.GetRefsFromJob(job); refs != nil {
+			return refs.BaseRef
+		}
+		return ""
+	},
+	"pull_number": func(job prowapiv1.ProwJob, _ string) string {
+		if pull := prow.GetPullFromJob(job); pull != nil {
+			return strconv.Itoa(pull.Number)
+		}
+		return ""
+	},
+	"pull_author": func(job prowapiv1.ProwJob, _ string) string {
+		if pull := prow.GetPullFromJob(job); pull != nil {
+			return pull.Author
+		}
+		return ""
+	},
+	"job_type": func(job prowapiv1.ProwJob, _ string) string {
+		return string(job.Spec.Type)
+	},
+	"cluster_alias": func(job prowapiv1.ProwJob, _ string) string {
+		return job.ClusterAlias()
+	},
+	"target": func(_ prowapiv1.ProwJob, target string) string {
+		return target
+	},
+	"variant": func(job prowapiv1.ProwJob, _ string) string {
+		return prow.GetVariantFromProwJob(job)
+	},
+	"job_url": func(job prowapiv1.ProwJob, _ string) string {
+		return job.Status.URL
+	},
+}
+
+// validateJobLabels checks that names are known opt-in labels, each given once.
+func validateJobLabels(names []string) error {
+	seen := map[string]bool{}
+	for _, name := range names {
+		if _, ok := jobLabels[name]; !ok {
+			return fmt.Errorf("unknown correlated metric label: %s", name)
+		}
+		if seen[name] {
+			return fmt.Errorf("correlated metric label given more than once: %s", name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+// jobLabelValues returns the value of each of the opt-in labels in names.
+func jobLabelValues(names []string, job prowapiv1.ProwJob, target string) []string {
+	if len(names) == 0 {
+		return nil
+	}
+	values := make([]string, 0, len(names))
+	for _, name := range names {
+		values = append(values, jobLabels[name](job, target))
+	}
+	return values
+}
+
+// newCorrelatedMetricDesc describes vsphere_ci_user_sessions_correlated with
+// the opt-in labels in names.
+func newCorrelatedMetricDesc(names []string) *prometheus.Desc {
+	labels := append(append([]string{}, correlatedMetricLabels...), names...)
+	return prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "correlated"),
+		"Correlated data between Prow and vCentre",
+		labels,
+		nil)
+}
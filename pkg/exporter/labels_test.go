@@ -0,0 +1,48 @@
+package exporter
+
+import (
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	prowapiv1 "k8s.io/test-infra/prow/apis/prowjobs/v1"
+	"testing"
+)
+
+func Test_validateJobLabels(t *testing.T) {
+	assert.Nil(t, validateJobLabels(nil))
+	assert.Nil(t, validateJobLabels([]string{"org", "repo", "job_url"}))
+	assert.NotNil(t, validateJobLabels([]string{"org", "username"}))
+	assert.NotNil(t, validateJobLabels([]string{"org", "org"}))
+}
+
+func Test_jobLabelValues(t *testing.T) {
+	job := prowapiv1.ProwJob{
+		Spec: prowapiv1.ProwJobSpec{
+			Type:    prowapiv1.PresubmitJob,
+			Cluster: "vsphere",
+			Refs: &prowapiv1.Refs{
+				Org:     "openshift",
+				Repo:    "installer",
+				BaseRef: "master",
+				Pulls:   []prowapiv1.Pull{{Number: 1234, Author: "someone"}},
+			},
+			PodSpec: &corev1.PodSpec{
+				Containers: []corev1.Container{{Args: []string{"--target=e2e-vsphere", "--variant=nightly-4.10"}}},
+			},
+		},
+		Status: prowapiv1.ProwJobStatus{URL: "https://prow.ci.openshift.org/view/gs/origin-ci-test/pr-logs/1"},
+	}
+
+	assert.Nil(t, jobLabelValues(nil, job, "e2e-vsphere"))
+	assert.Equal(t,
+		[]string{"openshift", "installer", "master", "1234", "someone", "presubmit", "vsphere", "e2e-vsphere", "nightly-4.10", "https://prow.ci.openshift.org/view/gs/origin-ci-test/pr-logs/1"},
+		jobLabelValues([]string{"org", "repo", "base_ref", "pull_number", "pull_author", "job_type", "cluster_alias", "target", "variant", "job_url"}, job, "e2e-vsphere"))
+
+	// Periodics have no pull request
+	periodic := prowapiv1.ProwJob{
+		Spec: prowapiv1.ProwJobSpec{
+			Type:      prowapiv1.PeriodicJob,
+			ExtraRefs: []prowapiv1.Refs{{Org: "openshift", Repo: "release"}},
+		},
+	}
+	assert.Equal(t, []string{"release", "", ""}, jobLabelValues([]string{"repo", "pull_number", "variant"}, periodic, ""))
+}
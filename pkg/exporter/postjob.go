@@ -0,0 +1,155 @@
+package exporter
+
+import (
+	"sort"
+	"time"
+
+	prowapiv1 "k8s.io/test-infra/prow/apis/prowjobs/v1"
+
+	"github.com/bostrt/vsphere-ci-session-metrics/pkg/service/vsphere"
+)
+
+// JobStateUnknown is the state of a finished job that dropped out of the
+// selected Prow jobs before its final state was seen.
+const JobStateUnknown = "unknown"
+
+// finishedJob is a job whose CI user was resolved while it ran, remembered
+// for a while after it finished.
+type finishedJob struct {
+	jobUser
+	State      string
+	FinishedAt time.Time
+}
+
+// jobKey identifies a CI user of a job on one vCenter. Targets sharing a CI
+// user, and so the same post_job series, share a key.
+type jobKey struct {
+	buildID  string
+	vcenter  string
+	username string
+}
+
+// jobTracker remembers the jobs seen running, so the sessions their CI users
+// leave behind can be found once the jobs finish.
+type jobTracker struct {
+	grace    time.Duration
+	running  map[jobKey]jobUser
+	finished map[jobKey]*finishedJob
+}
+
+func newJobTracker(grace time.Duration) *jobTracker {
+	return &jobTracker{
+		grace:    grace,
+		running:  map[jobKey]jobUser{},
+		finished: map[jobKey]*finishedJob{},
+	}
+}
+
+// update records the state of Prow as of now. active holds the build IDs of
+// every job still running, resolved the jobs among them whose CI user is known
+// and completed the finished jobs Prow still reports. Jobs that were running
+// and no longer are become finished.
+func (t *jobTracker) update(now time.Time, active map[string]bool, resolved []jobUser, completed map[string]prowapiv1.ProwJob) {
+	for _, ju := range resolved {
+		t.running[jobKey{ju.BuildID, ju.VCenter, ju.Username}] = ju
+	}
+
+	for k, ju := range t.running {
+		if active[k.buildID] {
+			continue
+		}
+		delete(t.running, k)
+		t.finished[k] = &finishedJob{
+			jobUser:    ju,
+			State:      JobStateUnknown,
+			FinishedAt: now,
+		}
+	}
+
+	for k, f := range t.finished {
+		if job, ok := completed[k.buildID]; ok && f.State == JobStateUnknown {
+			f.State = string(job.Status.State)
+			if job.Status.CompletionTime != nil {
+				f.FinishedAt = job.Status.CompletionTime.Time
+			}
+		}
+		if active[k.buildID] || now.Sub(f.FinishedAt) > t.grace {
+			delete(t.finished, k)
+		}
+	}
+}
+
+// finishedJobs returns the remembered finished jobs, oldest first.
+func (t *jobTracker) finishedJobs() []*finishedJob {
+	jobs := make([]*finishedJob, 0, len(t.finished))
+	for _, f := range t.finished {
+		jobs = append(jobs, f)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		if !jobs[i].FinishedAt.Equal(jobs[j].FinishedAt) {
+			return jobs[i].FinishedAt.Before(jobs[j].FinishedAt)
+		}
+		if jobs[i].BuildID != jobs[j].BuildID {
+			return jobs[i].BuildID < jobs[j].BuildID
+		}
+		if jobs[i].VCenter != jobs[j].VCenter {
+			return jobs[i].VCenter < jobs[j].VCenter
+		}
+		return jobs[i].Username < jobs[j].Username
+	})
+	return jobs
+}
+
+// postJobSessions counts the sessions finished jobs' CI users still hold.
+// Users with a running job are skipped, their sessions belong to that job. A
+// session is counted for the first job to finish after it logged in, so
+// sessions opened by a later job with the same CI user aren't blamed on an
+// earlier one.
+func postJobSessions(finished []*finishedJob, vsphereData map[string]*vsphere.VSphereUsers, correlatedUsers map[string]map[string]bool) []PostJobSessions {
+	type key struct {
+		job       int
+		userAgent string
+	}
+
+	counts := map[key]float64{}
+	var keys []key
+
+	for vcenter, v := range vsphereData {
+		jobsByUser := map[string][]int{}
+		for i, f := range finished {
+			if f.VCenter != vcenter || correlatedUsers[vcenter][f.Username] {
+				continue
+			}
+			jobsByUser[f.Username] = append(jobsByUser[f.Username], i)
+		}
+
+		for _, s := range v.Sessions {
+			for _, i := range jobsByUser[s.Username] {
+				if !s.LoginTime.IsZero() && s.LoginTime.After(finished[i].FinishedAt) {
+					continue
+				}
+				k := key{i, s.UserAgent}
+				if _, ok := counts[k]; !ok {
+					keys = append(keys, k)
+				}
+				counts[k]++
+				break
+			}
+		}
+	}
+
+	postJob := make([]PostJobSessions, 0, len(keys))
+	for _, k := range keys {
+		f := finished[k.job]
+		postJob = append(postJob, PostJobSessions{
+			Username:  f.Username,
+			UserAgent: k.userAgent,
+			Job:       f.Job,
+			BuildID:   f.BuildID,
+			JobState:  f.State,
+			VCenter:   f.VCenter,
+			Count:     counts[k],
+		})
+	}
+	return postJob
+}
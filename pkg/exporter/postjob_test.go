@@ -0,0 +1,89 @@
+package exporter
+
+import (
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	prowapiv1 "k8s.io/test-infra/prow/apis/prowjobs/v1"
+	"testing"
+	"time"
+
+	"github.com/bostrt/vsphere-ci-session-metrics/pkg/service/vsphere"
+)
+
+func Test_jobTracker_update(t *testing.T) {
+	tracker := newJobTracker(time.Hour)
+	now := time.Date(2022, 1, 1, 12, 0, 0, 0, time.UTC)
+	job1 := jobUser{Job: "e2e-vsphere", BuildID: "1", Username: "ci_user_01", VCenter: "vc1.example.com"}
+	job2 := jobUser{Job: "e2e-vsphere-upi", BuildID: "2", Username: "ci_user_02", VCenter: "vc1.example.com"}
+
+	tracker.update(now, map[string]bool{"1": true, "2": true}, []jobUser{job1, job2}, nil)
+	assert.Empty(t, tracker.finishedJobs())
+
+	// Job 1 isn't running anymore, job 2 is but couldn't be resolved this time
+	now = now.Add(time.Minute)
+	tracker.update(now, map[string]bool{"2": true}, nil, nil)
+	assert.Equal(t, []*finishedJob{{jobUser: job1, State: JobStateUnknown, FinishedAt: now}}, tracker.finishedJobs())
+
+	// Job 1's final state shows up
+	completionTime := now.Add(-30 * time.Second)
+	completed := map[string]prowapiv1.ProwJob{
+		"1": {Status: prowapiv1.ProwJobStatus{State: prowapiv1.FailureState, CompletionTime: &metav1.Time{Time: completionTime}}},
+	}
+	now = now.Add(time.Minute)
+	tracker.update(now, map[string]bool{"2": true}, []jobUser{job2}, completed)
+	assert.Equal(t, []*finishedJob{{jobUser: job1, State: "failure", FinishedAt: completionTime}}, tracker.finishedJobs())
+
+	// Grace window is over
+	now = completionTime.Add(time.Hour + time.Second)
+	tracker.update(now, map[string]bool{"2": true}, []jobUser{job2}, nil)
+	assert.Empty(t, tracker.finishedJobs())
+}
+
+func Test_jobTracker_update_MultiVCenter(t *testing.T) {
+	tracker := newJobTracker(time.Hour)
+	now := time.Date(2022, 1, 1, 12, 0, 0, 0, time.UTC)
+	vc1 := jobUser{Job: "e2e-vsphere-multi-vcenter", BuildID: "1", Target: "e2e-vsphere", Username: "ci_user_01", VCenter: "vc1.example.com"}
+	vc2 := jobUser{Job: "e2e-vsphere-multi-vcenter", BuildID: "1", Target: "e2e-vsphere", Username: "ci_user_02", VCenter: "vc2.example.com"}
+
+	tracker.update(now, map[string]bool{"1": true}, []jobUser{vc1, vc2}, nil)
+
+	// The target sharing the CI user changes, it is still the same series
+	now = now.Add(time.Minute)
+	vc1Upgrade := vc1
+	vc1Upgrade.Target = "e2e-vsphere-upgrade"
+	tracker.update(now, map[string]bool{"1": true}, []jobUser{vc1Upgrade, vc2}, nil)
+
+	now = now.Add(time.Minute)
+	tracker.update(now, map[string]bool{}, nil, nil)
+	assert.Equal(t, []*finishedJob{
+		{jobUser: vc1Upgrade, State: JobStateUnknown, FinishedAt: now},
+		{jobUser: vc2, State: JobStateUnknown, FinishedAt: now},
+	}, tracker.finishedJobs())
+}
+
+func Test_postJobSessions(t *testing.T) {
+	finishedAt := time.Date(2022, 1, 1, 12, 0, 0, 0, time.UTC)
+	finished := []*finishedJob{
+		{jobUser: jobUser{Job: "e2e-vsphere", BuildID: "1", Username: "ci_user_01", VCenter: "vc1.example.com"}, State: "success", FinishedAt: finishedAt},
+		{jobUser: jobUser{Job: "e2e-vsphere", BuildID: "2", Username: "ci_user_02", VCenter: "vc1.example.com"}, State: JobStateUnknown, FinishedAt: finishedAt},
+	}
+	vsphereData := map[string]*vsphere.VSphereUsers{
+		"vc1.example.com": {
+			Sessions: []vsphere.UserSession{
+				{Username: "ci_user_01", UserAgent: "govc", LoginTime: finishedAt.Add(-time.Hour)},
+				{Username: "ci_user_01", UserAgent: "govc", LoginTime: finishedAt.Add(-time.Minute)},
+				// Logged in after the job finished
+				{Username: "ci_user_01", UserAgent: "terraform", LoginTime: finishedAt.Add(time.Minute)},
+				// Held by a running job
+				{Username: "ci_user_02", UserAgent: "govc", LoginTime: finishedAt.Add(-time.Hour)},
+			},
+		},
+	}
+	correlatedUsers := map[string]map[string]bool{
+		"vc1.example.com": {"ci_user_02": true},
+	}
+
+	assert.Equal(t, []PostJobSessions{
+		{Username: "ci_user_01", UserAgent: "govc", Job: "e2e-vsphere", BuildID: "1", JobState: "success", VCenter: "vc1.example.com", Count: 2},
+	}, postJobSessions(finished, vsphereData, correlatedUsers))
+}
@@ -3,7 +3,7 @@ package exporter
 import (
 	"context"
 	"fmt"
-	"net/url"
+	"regexp"
 	"sync"
 	"time"
 
@@ -11,256 +11,924 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 	"github.com/vmware/govmomi"
-	"github.com/vmware/govmomi/vim25/soap"
-	"k8s.io/client-go/kubernetes"
-	prowclient "k8s.io/test-infra/prow/client/clientset/versioned"
+	prowapiv1 "k8s.io/test-infra/prow/apis/prowjobs/v1"
 
 	"github.com/bostrt/vsphere-ci-session-metrics/pkg/service/build"
+	"github.com/bostrt/vsphere-ci-session-metrics/pkg/service/kube"
 	"github.com/bostrt/vsphere-ci-session-metrics/pkg/service/prow"
 	"github.com/bostrt/vsphere-ci-session-metrics/pkg/service/vsphere"
 )
 
+var errUnknownBuildCluster = errors.New("no build cluster configured for job")
+
+// Phases of a refresh
+const (
+	phaseVCenterLogin   = "vcenter_login"
+	phaseSessionListing = "session_listing"
+	phaseProwFetch      = "prow_fetch"
+	phaseBuildLookup    = "build_lookup"
+)
+
+// Upstreams whose health is tracked
+const (
+	upstreamVCenter      = "vcenter"
+	upstreamProw         = "prow"
+	upstreamBuildCluster = "build_cluster"
+
+	// Name of the build cluster when only a kubeconfig is given. Every job is
+	// looked up in it.
+	defaultBuildCluster = "default"
+
+	// How often the ProwJob cache is resynced when watching ProwJobs
+	prowInformerResync = 10 * time.Minute
+)
+
 var (
 	namespace = "vsphere_ci_user_sessions"
 
-	correlatedMetricDesc = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "", "correlated"),
-		"Correlated data between Prow and vCentre",
-		[]string{"username", "user_agent", "ci_job", "build_id", "pull_request", "vcenter"},
+	correlatedMetricType = prometheus.GaugeValue
+
+	uncorrelatedMetricDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "uncorrelated"),
+		"vCentre sessions of users that have no running Prow job",
+		[]string{"username", "user_agent", "vcenter"},
 		nil)
 
-	correlatedMetricType = prometheus.GaugeValue
+	postJobMetricDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "post_job"),
+		"vCentre sessions still held by the CI user of a Prow job after it finished",
+		[]string{"username", "user_agent", "ci_job", "build_id", "job_state", "vcenter"},
+		nil)
+
+	// Bucket bounds, in seconds, for session age and idle time
+	sessionTimeBuckets = []float64{60, 5 * 60, 15 * 60, 30 * 60, 60 * 60, 2 * 60 * 60, 4 * 60 * 60, 8 * 60 * 60, 24 * 60 * 60}
+
+	sessionAgeSecondsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "session_age_seconds"),
+		"Time since vCentre sessions were logged in",
+		[]string{"username", "user_agent", "vcenter"},
+		nil)
+
+	sessionIdleSecondsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "session_idle_seconds"),
+		"Time since vCentre sessions were last active",
+		[]string{"username", "user_agent", "vcenter"},
+		nil)
+
+	idleSessionsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "idle_sessions"),
+		"vCentre sessions idle for longer than the idle threshold",
+		[]string{"username", "user_agent", "vcenter"},
+		nil)
+
+	vcenterSessionsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "vcenter_sessions"),
+		"Total sessions open on the vCentre",
+		[]string{"vcenter"},
+		nil)
+
+	lastSuccessfulRefreshDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "last_successful_refresh_timestamp_seconds"),
+		"Unix time of the last refresh where every upstream was reachable",
+		nil,
+		nil)
+
+	snapshotAgeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "snapshot_age_seconds"),
+		"Seconds since the currently served data was gathered",
+		nil,
+		nil)
+
+	unmonitoredVCenterJobsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "unmonitored_vcenter_jobs"),
+		"Prow jobs whose metadata.json names a vCenter that isn't monitored",
+		[]string{"vcenter"},
+		nil)
+
+	prowJobsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "prow_jobs"),
+		"Selected Prow jobs by state, type, repository and cluster alias",
+		[]string{"state", "job_type", "org", "repo", "cluster_alias"},
+		nil)
+
+	oldestPendingJobAgeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "oldest_pending_job_age_seconds"),
+		"Time the oldest selected pending Prow job has been pending",
+		nil,
+		nil)
+
+	// Not under namespace, it describes jobs rather than sessions
+	jobInfoDesc = prometheus.NewDesc(
+		"vsphere_ci_job_info",
+		"Where running Prow jobs install their clusters, one series per failure domain",
+		[]string{"ci_job", "build_id", "target", "username", "vcenter", "infra_id", "failure_domain", "datacenter", "cluster", "datastore", "network"},
+		nil)
+
+	resolutionCacheEntriesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "resolution_cache_entries"),
+		"Jobs whose CI users, or failure to resolve them, are cached",
+		[]string{"build_cluster"},
+		nil)
+
+	sessionReloginsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "vcenter_session_relogins_total"),
+		"Times the exporter's own vCenter session had to be re-established",
+		[]string{"vcenter"},
+		nil)
+
+	sessionAgeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "vcenter_session_age_seconds"),
+		"Age of the exporter's own vCenter session",
+		[]string{"vcenter"},
+		nil)
+
+	unresolvedJobsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "unresolved_jobs"),
+		"Running Prow jobs whose CI user couldn't be found, so their sessions look uncorrelated",
+		nil,
+		nil)
 )
 
 type Exporter struct {
-	vcenter          string
-	prowURI          string
+	prowHost         string
 	mutex            sync.RWMutex
 	warningThreshold float64
-
-	vsphereHost      string
-	vsphereUser      string
-	vspherePasswd    string
-	vsphereUserAgent string
-	buildClientset   *kubernetes.Clientset
-	prowClientset    *prowclient.Clientset
+	refreshInterval  time.Duration
+	idleThreshold    time.Duration
+	jobLabels        []string // Opt-in labels of the correlated metric
+	jobInfo          bool     // Whether vsphere_ci_job_info is exported
+	correlatedDesc   *prometheus.Desc
+	stop             chan struct{}
+	done             chan struct{}
+
+	// Latest data gathered by the background refresh loop. Guarded by mutex.
+	snapshot           *Snapshot
+	lastSuccessRefresh time.Time
+
+	vcenters         []string // Hosts, in configured order
+	vsphereSessions  map[string]*vsphere.Session
+	buildClusters    []string                   // Names, in configured order
+	buildResolvers   map[string]*build.Resolver // By build cluster name
+	fallbackCluster  string                     // Where jobs on other clusters are looked up, if anywhere
+	prowDataProvider prow.DataProvider
+
+	// Jobs seen running, and recently finished. Only used by the refresh loop.
+	jobs *jobTracker
 
 	// Metrics of exporter itself
-	// TODO Include Prow and vCenter names in these metrics!
-	totalScrapes prometheus.Counter
-	vcenterUp    prometheus.Gauge
-	prowUp       prometheus.Gauge
+	totalScrapes   prometheus.Counter
+	totalRefreshes prometheus.Counter
+	vcenterUp      *prometheus.GaugeVec
+	prowUp         *prometheus.GaugeVec
+	buildUp        *prometheus.GaugeVec
+
+	// When each upstream last failed
+	lastUpstreamError *prometheus.GaugeVec
+
+	// Durations and failures of each phase of a refresh
+	phaseDuration *prometheus.HistogramVec
+	phaseErrors   *prometheus.CounterVec
+
+	// Failed build lookups, by build cluster
+	buildLookupErrors *prometheus.CounterVec
+
+	// How the ci-op-* namespace of jobs was found
+	namespaceDiscoveries *prometheus.CounterVec
+
+	// Lookups of CI users in the resolution cache, by result
+	resolutionCacheLookups *prometheus.CounterVec
+
+	// Requests whose credentials were rejected, by upstream
+	unauthorizedRequests *prometheus.CounterVec
+}
+
+// Start launches the background loop that refreshes the snapshot served by
+// Collect every refreshInterval. The first refresh happens immediately.
+func (e *Exporter) Start() {
+	go func() {
+		defer close(e.done)
+
+		ticker := time.NewTicker(e.refreshInterval)
+		defer ticker.Stop()
+
+		for {
+			e.refresh()
+
+			select {
+			case <-ticker.C:
+			case <-e.stop:
+				return
+			}
+		}
+	}()
 }
 
 func (e *Exporter) Shutdown() {
 	log.Info("shutting down exporter...")
+	close(e.stop)
+	<-e.done
+
+	if s, ok := e.prowDataProvider.(interface{ Stop() }); ok {
+		s.Stop()
+	}
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 60*time.Second)
+	defer cancel()
+	for _, s := range e.vsphereSessions {
+		s.Logout(ctx)
+	}
 }
 
 func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
 	ch <- e.totalScrapes.Desc()
-	ch <- e.vcenterUp.Desc()
-	ch <- e.prowUp.Desc()
-	// ...
+	ch <- e.totalRefreshes.Desc()
+	e.vcenterUp.Describe(ch)
+	e.prowUp.Describe(ch)
+	e.buildUp.Describe(ch)
+	e.lastUpstreamError.Describe(ch)
+	e.phaseDuration.Describe(ch)
+	e.phaseErrors.Describe(ch)
+	e.buildLookupErrors.Describe(ch)
+	e.namespaceDiscoveries.Describe(ch)
+	e.resolutionCacheLookups.Describe(ch)
+	e.unauthorizedRequests.Describe(ch)
+	ch <- resolutionCacheEntriesDesc
+	if c, ok := e.prowDataProvider.(prometheus.Collector); ok {
+		c.Describe(ch)
+	}
+	ch <- e.correlatedDesc
+	ch <- lastSuccessfulRefreshDesc
+	ch <- snapshotAgeDesc
+	ch <- unmonitoredVCenterJobsDesc
+	ch <- prowJobsDesc
+	ch <- oldestPendingJobAgeDesc
+	ch <- jobInfoDesc
+	ch <- uncorrelatedMetricDesc
+	ch <- postJobMetricDesc
+	ch <- vcenterSessionsDesc
+	ch <- unresolvedJobsDesc
+	ch <- sessionAgeSecondsDesc
+	ch <- sessionIdleSecondsDesc
+	ch <- idleSessionsDesc
+	ch <- sessionReloginsDesc
+	ch <- sessionAgeDesc
 }
 
 func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
-	e.mutex.Lock() // To protect metrics from concurrent collects.
-	defer e.mutex.Unlock()
-
-	log.Debug("Metric collection starting...")
-	start := time.Now()
-	vcenterUp, prowUp := e.scrape(ch)
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
 
-	e.vcenterUp.Set(vcenterUp)
-	e.prowUp.Set(prowUp)
-
-	ch <- e.vcenterUp
-	ch <- e.prowUp
+	e.vcenterUp.Collect(ch)
+	e.prowUp.Collect(ch)
+	e.totalScrapes.Inc()
 	ch <- e.totalScrapes
+	ch <- e.totalRefreshes
+	e.buildUp.Collect(ch)
+	e.lastUpstreamError.Collect(ch)
+	e.phaseDuration.Collect(ch)
+	e.phaseErrors.Collect(ch)
+	e.buildLookupErrors.Collect(ch)
+	e.namespaceDiscoveries.Collect(ch)
+	e.resolutionCacheLookups.Collect(ch)
+	e.unauthorizedRequests.Collect(ch)
+	for _, name := range e.buildClusters {
+		ch <- prometheus.MustNewConstMetric(resolutionCacheEntriesDesc,
+			prometheus.GaugeValue,
+			float64(e.buildResolvers[name].CacheSize()),
+			name)
+	}
+	if c, ok := e.prowDataProvider.(prometheus.Collector); ok {
+		// Providers may expose metrics about themselves
+		c.Collect(ch)
+	}
 
-	duration := time.Since(start)
-	if duration.Seconds() > e.warningThreshold {
-		log.Warnf("scrape operation took too long: %.2fs", duration.Seconds())
+	for _, host := range e.vcenters {
+		s := e.vsphereSessions[host]
+		ch <- prometheus.MustNewConstMetric(sessionReloginsDesc,
+			prometheus.CounterValue,
+			s.Relogins(),
+			host)
+		ch <- prometheus.MustNewConstMetric(sessionAgeDesc,
+			prometheus.GaugeValue,
+			s.Age().Seconds(),
+			host)
 	}
 
-	log.Debug("Metric collection complete.")
-}
+	if e.snapshot == nil {
+		// Nothing has been gathered yet
+		return
+	}
 
-func (e *Exporter) vSphereLogin() (*govmomi.Client, error) {
-	ctx, cancel := context.WithTimeout(context.TODO(), 60*time.Second)
-	defer cancel()
+	e.snapshot.collect(ch, e.correlatedDesc)
 
-	u, err := soap.ParseURL(fmt.Sprintf("https://%s", e.vsphereHost))
-	if err != nil {
-		return nil, err
+	if !e.lastSuccessRefresh.IsZero() {
+		ch <- prometheus.MustNewConstMetric(lastSuccessfulRefreshDesc,
+			prometheus.GaugeValue,
+			float64(e.lastSuccessRefresh.UnixNano())/1e9)
 	}
+	ch <- prometheus.MustNewConstMetric(snapshotAgeDesc,
+		prometheus.GaugeValue,
+		time.Since(e.snapshot.Timestamp).Seconds())
+}
 
-	// Get vSphere User Sessions
-	u.User = nil
-	c, err := govmomi.NewClient(ctx, u, true)
-	if err != nil {
-		return nil, err
+// refresh gathers a new snapshot from vCenter, Prow and the build cluster and
+// swaps it in for the one served by Collect.
+func (e *Exporter) refresh() {
+	log.Debug("Refresh starting...")
+	start := time.Now()
+	snapshot := e.scrape()
+
+	e.mutex.Lock()
+	e.snapshot = snapshot
+	for host, up := range snapshot.VCenterUp {
+		e.vcenterUp.WithLabelValues(host).Set(up)
+	}
+	e.prowUp.WithLabelValues(e.prowHost).Set(snapshot.ProwUp)
+	for cluster, up := range snapshot.BuildClusterUp {
+		e.buildUp.WithLabelValues(cluster).Set(up)
+	}
+	if snapshot.Successful() {
+		e.lastSuccessRefresh = snapshot.Timestamp
 	}
+	e.mutex.Unlock()
 
-	c.UserAgent = e.vsphereUserAgent
-	err = c.Login(ctx, url.UserPassword(e.vsphereUser, e.vspherePasswd))
-	if err != nil {
-		return nil, err
+	duration := time.Since(start)
+	if duration.Seconds() > e.warningThreshold {
+		log.Warnf("refresh operation took too long: %.2fs", duration.Seconds())
 	}
 
-	return c, nil
+	log.Debug("Refresh complete.")
 }
 
-func (e *Exporter) scrape(ch chan<- prometheus.Metric) (vcenterUp float64, prowUp float64) {
+func (e *Exporter) scrape() *Snapshot {
 	ctx, cancel := context.WithTimeout(context.TODO(), 60*time.Second)
 	defer cancel()
 
-	e.totalScrapes.Inc()
+	e.totalRefreshes.Inc()
 
-	c, err := e.vSphereLogin()
-	if err != nil {
-		log.Error(err)
-		return
+	snapshot := &Snapshot{
+		Timestamp:              time.Now(),
+		VCenterUp:              map[string]float64{},
+		BuildClusterUp:         map[string]float64{},
+		UnmonitoredVCenterJobs: map[string]float64{},
+		VCenterSessions:        map[string]float64{},
 	}
-	defer c.Logout(ctx)
 
-	v, err := vsphere.GetVsphereData(c)
-	if err != nil {
-		log.Error(errors.Wrap(err, "failed scraping vsphere"))
-		return
+	// Sessions of every reachable vCenter, by host
+	vsphereData := map[string]*vsphere.VSphereUsers{}
+	for _, host := range e.vcenters {
+		snapshot.VCenterUp[host] = 0
+
+		// Logins are observed by the session itself
+		err := e.vsphereSessions[host].Login(ctx)
+		if err != nil {
+			log.Error(err)
+			e.upstreamError(upstreamVCenter, host)
+			continue
+		}
+
+		var v *vsphere.VSphereUsers
+		start := time.Now()
+		err = e.vsphereSessions[host].Do(ctx, func(c *govmomi.Client) (err error) {
+			v, err = vsphere.GetVsphereData(ctx, c)
+			return err
+		})
+		e.observe(phaseSessionListing, start, err)
+		if err != nil {
+			log.Error(errors.Wrapf(err, "failed scraping vsphere %s", host))
+			e.upstreamError(upstreamVCenter, host)
+			continue
+		}
+
+		vsphereData[host] = v
+		snapshot.VCenterUp[host] = 1
+		snapshot.VCenterSessions[host] = v.Total()
+		snapshot.SessionTimes = append(snapshot.SessionTimes, sessionTimes(host, v, e.idleThreshold)...)
 	}
 
 	// Get Prow Jobs on vSphere
-	var prowDataProvider prow.DataProvider
-	if e.prowClientset == nil {
-		// Pull data anonymously. This doesn't utilize server-side job filtering.
-		prowDataProvider = prow.AnonymousDataProvider{}
+	start := time.Now()
+	prowData, prowErr := e.prowDataProvider.GetData(ctx)
+	e.observe(phaseProwFetch, start, prowErr)
+	if prowErr != nil {
+		log.Error(errors.Wrap(prowErr, "failed to get prow jobs"))
+		if kube.IsUnauthorized(prowErr) {
+			log.Warn("Prow cluster rejected our credentials, they may have expired")
+		}
+		e.upstreamError(upstreamProw, e.prowHost)
 	} else {
-		// Call to K8s API for Prow Jobs
-		prowDataProvider, err = prow.NewAuthenticatedDataProvier(e.prowClientset)
+		snapshot.ProwUp = 1
+		snapshot.ProwJobs, snapshot.OldestPendingJobAge = prowJobCounts(prowData, snapshot.Timestamp)
+	}
+
+	// Make sure each build cluster is reachable before looking up its jobs
+	buildUp := map[string]bool{}
+	for _, name := range e.buildClusters {
+		err := e.buildResolvers[name].Ping()
 		if err != nil {
-			log.Error(err)
-			return 1, 0
+			log.Error(errors.Wrapf(err, "failed to reach build cluster %s", name))
+			if kube.IsUnauthorized(err) {
+				log.Warnf("build cluster %s rejected our credentials, they may have expired", name)
+			}
+			e.upstreamError(upstreamBuildCluster, name)
+			snapshot.BuildClusterUp[name] = 0
+			continue
 		}
+		buildUp[name] = true
+		snapshot.BuildClusterUp[name] = 1
 	}
 
-	prowData, err := prowDataProvider.GetData()
-	if err != nil {
-		log.Error(errors.Wrap(err, "failed to get prow jobs"))
+	// Correlation needs every upstream. The vSphere only metrics above are
+	// still served when it can't be done.
+	if len(vsphereData) == 0 || prowErr != nil || len(buildUp) == 0 {
+		return snapshot
 	}
+	snapshot.JobsCorrelated = true
+
+	// Set when jobs couldn't be looked up because their build cluster is
+	// down, so users without a job can't be told apart
+	incomplete := false
+
+	// Users with a running job, by vCenter
+	correlatedUsers := map[string]map[string]bool{}
+	jobsByVCenter := map[string][]jobUser{}
+
+	// Jobs still running, by build ID, and finished jobs Prow still reports
+	active := map[string]bool{}
+	completed := map[string]prowapiv1.ProwJob{}
+	var resolved []jobUser
 
 	// Bring together data from Prow and vSphere.
 	// Loop over each vSphere Prow Job and find the CI User assoicated
 	// with it by querying the Build cluster.
 	for _, job := range prowData {
-		buildId := job.GetLabels()["prow.k8s.io/build-id"]
-		jobName := job.GetAnnotations()["prow.k8s.io/job"]
-		pullLink := prow.GetPRLinkFromJob(job)
-		target, err := prow.GetTargetFromProwJob(job)
+		buildID := job.GetLabels()["prow.k8s.io/build-id"]
+		if job.Complete() {
+			// Only used to tell how jobs we saw running ended
+			completed[buildID] = job
+			continue
+		}
+		active[buildID] = true
+
+		cluster, err := e.buildClusterFor(job)
 		if err != nil {
-			log.Debug(err)
+			e.observeBuildLookup(job.ClusterAlias(), time.Now(), err)
+			log.Debugf("build-id %s: %s", buildID, err)
+			snapshot.UnresolvedJobs++
+			continue
+		}
+		if !buildUp[cluster] {
+			incomplete = true
+			snapshot.UnresolvedJobs++
 			continue
 		}
 
-		log.Debugf("build-id: %s job: %s PR: %s", buildId, jobName, pullLink)
+		start := time.Now()
+		jobUsers, err := e.resolveJob(job, cluster)
+		e.observeBuildLookup(cluster, start, err)
 
-		// Get CI username from metadata.json for the job
-		user, err := build.GetCIUserForBuildID(buildId, target, e.buildClientset)
+		var unmonitored *build.UnmonitoredVCenterError
+		if errors.As(err, &unmonitored) {
+			log.Warnf("build-id %s: %s", buildID, err)
+			snapshot.UnmonitoredVCenterJobs[unmonitored.VCenter]++
+			continue
+		}
 		if err != nil {
 			log.Debug(err)
+			snapshot.UnresolvedJobs++
 			continue
 		}
+		resolved = append(resolved, jobUsers...)
+
+		for _, ju := range jobUsers {
+			if _, ok := vsphereData[ju.VCenter]; !ok {
+				log.Debugf("build-id %s uses vCenter %s which is not reachable", ju.BuildID, ju.VCenter)
+				continue
+			}
+
+			if correlatedUsers[ju.VCenter] == nil {
+				correlatedUsers[ju.VCenter] = map[string]bool{}
+			}
+			correlatedUsers[ju.VCenter][ju.Username] = true
+			jobsByVCenter[ju.VCenter] = append(jobsByVCenter[ju.VCenter], ju)
+		}
+	}
+
+	// Jobs that stopped running won't be looked up again
+	for _, resolver := range e.buildResolvers {
+		resolver.Forget(active)
+	}
+
+	e.listSharedUserIPs(jobsByVCenter)
+	for vcenter, jobs := range jobsByVCenter {
+		snapshot.Correlated = append(snapshot.Correlated, correlate(jobs, vsphereData[vcenter])...)
+	}
+
+	e.jobs.update(snapshot.Timestamp, active, resolved, completed)
+	if e.jobInfo {
+		snapshot.JobInfo = jobInfo(resolved)
+	}
+	if incomplete {
+		log.Debug("skipping uncorrelated and post-job sessions, a build cluster with running jobs is down")
+		return snapshot
+	}
+
+	snapshot.Uncorrelated = uncorrelatedSessions(vsphereData, correlatedUsers)
+	snapshot.PostJob = postJobSessions(e.jobs.finishedJobs(), vsphereData, correlatedUsers)
+
+	return snapshot
+}
+
+// buildClusterFor returns the name of the build cluster a job is looked up in.
+func (e *Exporter) buildClusterFor(job prowapiv1.ProwJob) (string, error) {
+	alias := job.ClusterAlias()
+	if _, ok := e.buildResolvers[alias]; ok {
+		return alias, nil
+	}
+	if e.fallbackCluster != "" {
+		return e.fallbackCluster, nil
+	}
+	return "", errors.Wrapf(errUnknownBuildCluster, "cluster %s", alias)
+}
+
+// resolveJob finds the CI users of a Prow job by querying its build cluster.
+// Jobs with several ci-operator targets have a CI user per target, targets
+// sharing a CI user are only returned once.
+func (e *Exporter) resolveJob(job prowapiv1.ProwJob, cluster string) ([]jobUser, error) {
+	resolver := e.buildResolvers[cluster]
+	buildId := job.GetLabels()["prow.k8s.io/build-id"]
+	jobName := job.GetAnnotations()["prow.k8s.io/job"]
+	pullLink := prow.GetPRLinkFromJob(job)
+	targets, err := prow.GetTargetsFromProwJob(job)
+	if err != nil {
+		return nil, errors.Wrapf(err, "build-id %s", buildId)
+	}
+
+	log.Debugf("build-id: %s job: %s PR: %s targets: %v", buildId, jobName, pullLink, targets)
+
+	// Get CI username and vCenter from metadata.json for each target
+	ciUsers, err := resolver.GetCIUsersForBuildID(buildId, targets)
+	if err != nil {
+		return nil, err
+	}
 
+	var jobUsers []jobUser
+	seen := map[string]bool{}
+	for _, ciUser := range ciUsers {
 		// We're assuming @vsphere.local, strip it away
-		user = vsphere.StripDomain(user)
+		user := vsphere.StripDomain(ciUser.Username)
 		if user == "" {
-			log.Tracef("cannot strip domain from user")
-			continue
+			return nil, errors.Wrapf(build.ErrUserNotParsed, "cannot strip domain from user %s", ciUser.Username)
 		}
 
-		// Get map[string]float64 which contains user agent count summary
-		userAgents := v.GetUserAgentsForUser(user)
-		if userAgents == nil {
-			log.Debugf("no sessions for user: %s", user)
+		if seen[ciUser.VCenter+"/"+user] {
 			continue
 		}
+		seen[ciUser.VCenter+"/"+user] = true
+
+		jobUsers = append(jobUsers, jobUser{
+			Job:         jobName,
+			BuildID:     buildId,
+			Target:      ciUser.Target,
+			PullRequest: pullLink,
+			Username:    user,
+			VCenter:     ciUser.VCenter,
+			ExtraLabels: jobLabelValues(e.jobLabels, job, ciUser.Target),
+
+			BuildCluster: cluster,
+			Namespace:    ciUser.Namespace,
+
+			InfraID:        ciUser.InfraID,
+			FailureDomains: ciUser.FailureDomains,
+		})
+	}
+	return jobUsers, nil
+}
 
-		for userAgent, count := range userAgents {
-			ch <- prometheus.MustNewConstMetric(correlatedMetricDesc,
-				correlatedMetricType,
-				count,
-				user,
-				userAgent,
-				jobName,
-				buildId,
-				pullLink,
-				"ibmvcenter.vmc-ci.devcluster.openshift.com")
+// listSharedUserIPs fills in the pod IPs of jobs sharing a CI user with
+// another job on the same vCenter. Only those need telling apart, so the pods
+// of other jobs aren't listed.
+func (e *Exporter) listSharedUserIPs(jobsByVCenter map[string][]jobUser) {
+	// Every target of a job runs in the same namespace
+	ipsByNamespace := map[string]map[string]bool{}
+	for _, jobs := range jobsByVCenter {
+		jobsByUser := map[string]int{}
+		for _, ju := range jobs {
+			jobsByUser[ju.Username]++
+		}
+
+		for i := range jobs {
+			ju := &jobs[i]
+			if jobsByUser[ju.Username] < 2 {
+				continue
+			}
+
+			key := ju.BuildCluster + "/" + ju.Namespace
+			ips, ok := ipsByNamespace[key]
+			if !ok {
+				ips = map[string]bool{}
+				podIPs, err := e.buildResolvers[ju.BuildCluster].GetPodIPs(ju.Namespace)
+				if err != nil {
+					log.Debug(err)
+				}
+				for _, ip := range podIPs {
+					ips[ip] = true
+				}
+				ipsByNamespace[key] = ips
+			}
+			ju.IPs = ips
 		}
 	}
+}
+
+// upstreamError records that an upstream failed just now.
+func (e *Exporter) upstreamError(upstream, name string) {
+	e.lastUpstreamError.WithLabelValues(upstream, name).SetToCurrentTime()
+}
 
-	return 1, 1
+// observe records how long a phase of a refresh took and, if it failed, why.
+func (e *Exporter) observe(phase string, start time.Time, err error) {
+	e.phaseDuration.WithLabelValues(phase).Observe(time.Since(start).Seconds())
+	if err != nil {
+		e.phaseErrors.WithLabelValues(phase, errorReason(err)).Inc()
+	}
+}
+
+// observeBuildLookup observes a build lookup like observe does, and also
+// counts failures by the build cluster they happened on.
+func (e *Exporter) observeBuildLookup(cluster string, start time.Time, err error) {
+	e.observe(phaseBuildLookup, start, err)
+	if err != nil {
+		e.buildLookupErrors.WithLabelValues(cluster, errorReason(err)).Inc()
+	}
+}
+
+// errorReason sorts an error from a refresh into a short label value.
+func errorReason(err error) string {
+	var unmonitored *build.UnmonitoredVCenterError
+	var podLogs *build.PodLogsError
+	switch {
+	case errors.Is(err, build.ErrJobPodNotFound):
+		return "pod_not_found"
+	case errors.Is(err, build.ErrNamespaceNotInLogs):
+		return "namespace_not_in_logs"
+	case errors.As(err, &podLogs):
+		return "pod_logs_unavailable"
+	case errors.Is(err, build.ErrSecretMissing):
+		return "secret_missing"
+	case errors.Is(err, build.ErrUserNotParsed):
+		return "user_not_parsed"
+	case errors.Is(err, prow.ErrTargetNotFound):
+		return "target_not_found"
+	case errors.Is(err, errUnknownBuildCluster):
+		return "unknown_build_cluster"
+	case errors.As(err, &unmonitored):
+		return "unmonitored_vcenter"
+	case vsphere.IsNotAuthenticated(err):
+		return "not_authenticated"
+	case kube.IsUnauthorized(err):
+		return "unauthorized"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	}
+	return "other"
 }
 
-func NewExporter(warning float64, buildKubeconfig, prowKubeconfig, vsphereHost, vsphereUser, vspherePasswd, vsphereUserAgent, prowURI string) (*Exporter, error) {
+func NewExporter(config Config) (*Exporter, error) {
 	ctx, cancel := context.WithTimeout(context.TODO(), 60*time.Second)
 	defer cancel()
 
-	u, err := soap.ParseURL(fmt.Sprintf("https://%s", vsphereHost))
-	if err != nil {
-		return nil, err
+	phaseDuration := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "phase_duration_seconds",
+		Help:      "Time taken by each phase of a refresh.",
+		Buckets:   []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"phase"})
+	phaseErrors := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "phase_errors_total",
+		Help:      "Failures during each phase of a refresh, by reason.",
+	}, []string{"phase", "reason"})
+
+	// A session per vSphere, kept for every refresh. They are only logged in
+	// once the rest of the config is known to be good, so a bad config doesn't
+	// leave sessions behind.
+	var vcenters []string
+	vsphereSessions := map[string]*vsphere.Session{}
+	for _, vc := range config.VCenters {
+		if _, ok := vsphereSessions[vc.Host]; ok {
+			return nil, fmt.Errorf("vCenter %s configured more than once", vc.Host)
+		}
+
+		s := vsphere.NewSession(vc.Host, vc.User, vc.Password, vc.UserAgent)
+		s.OnLogin = func(duration time.Duration, err error) {
+			phaseDuration.WithLabelValues(phaseVCenterLogin).Observe(duration.Seconds())
+			if err != nil {
+				phaseErrors.WithLabelValues(phaseVCenterLogin, errorReason(err)).Inc()
+			}
+		}
+		vcenters = append(vcenters, vc.Host)
+		vsphereSessions[vc.Host] = s
+	}
+
+	// Only accept CI users for the vCenters we watch, unless told otherwise
+	ciVCenters := config.CIVCenters
+	if len(ciVCenters) == 0 {
+		ciVCenters = vcenters
+	}
+
+	var namespaceRegex *regexp.Regexp
+	if config.NamespaceRegex != "" {
+		var err error
+		namespaceRegex, err = build.ParseNamespaceRegex(config.NamespaceRegex)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	namespaceDiscoveries := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "namespace_discoveries_total",
+		Help:      "ci-op-* namespaces found, by build cluster and the strategy that found them.",
+	}, []string{"build_cluster", "strategy"})
+	resolutionCacheLookups := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "resolution_cache_lookups_total",
+		Help:      "Lookups of the CI users of jobs in the resolution cache, by build cluster and result.",
+	}, []string{"build_cluster", "result"})
+	unauthorizedRequests := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "unauthorized_requests_total",
+		Help:      "Kubernetes API requests whose credentials were rejected, e.g. because they expired.",
+	}, []string{"upstream", "name"})
+
+	// Without a list of build clusters, every job is looked up in the one
+	// given by BuildAuth
+	buildClusters := config.BuildClusters
+	var fallbackCluster string
+	if len(buildClusters) == 0 {
+		buildClusters = []BuildCluster{{Name: defaultBuildCluster}}
+		fallbackCluster = defaultBuildCluster
 	}
 
-	u.User = nil
-	c, err := govmomi.NewClient(ctx, u, true)
+	var buildClusterNames []string
+	buildResolvers := map[string]*build.Resolver{}
+	for _, bc := range buildClusters {
+		if _, ok := buildResolvers[bc.Name]; ok {
+			return nil, fmt.Errorf("build cluster %s configured more than once", bc.Name)
+		}
+
+		name := bc.Name
+		restConfig, err := kube.RESTConfig(bc.auth(config.BuildAuth))
+		if err != nil {
+			return nil, errors.Wrapf(err, "build cluster %s", name)
+		}
+		kube.OnUnauthorized(restConfig, func() {
+			unauthorizedRequests.WithLabelValues(upstreamBuildCluster, name).Inc()
+		})
+		clientset, err := build.BuildClient(restConfig)
+		if err != nil {
+			return nil, errors.Wrapf(err, "build cluster %s", name)
+		}
+
+		resolver := build.NewResolver(clientset, build.ResolverConfig{
+			VCenters:       ciVCenters,
+			BuildIDLabel:   config.BuildIDLabel,
+			LogContainer:   config.BuildLogContainer,
+			NamespaceRegex: namespaceRegex,
+			LogLimitBytes:  config.BuildLogLimitBytes,
+
+			CacheTTL:         config.ResolutionCacheTTL,
+			NegativeCacheTTL: config.ResolutionNegativeCacheTTL,
+		})
+		resolver.OnNamespaceFound = func(strategy string) {
+			namespaceDiscoveries.WithLabelValues(name, strategy).Inc()
+		}
+		resolver.OnCacheLookup = func(result string) {
+			resolutionCacheLookups.WithLabelValues(name, result).Inc()
+		}
+
+		buildClusterNames = append(buildClusterNames, bc.Name)
+		buildResolvers[bc.Name] = resolver
+	}
+
+	prowURL, err := prow.ParseBaseURL(config.ProwURI)
 	if err != nil {
 		return nil, err
 	}
 
-	// Test login with vSphere
-	c.UserAgent = vsphereUserAgent
-	err = c.Login(ctx, url.UserPassword(vsphereUser, vspherePasswd))
+	err = validateJobLabels(config.CorrelatedLabels)
 	if err != nil {
 		return nil, err
 	}
-	defer c.Logout(ctx)
 
-	buildClientset, err := build.BuildClient(buildKubeconfig)
+	selector, err := prow.NewSelector(config.ProwSelector)
 	if err != nil {
 		return nil, err
 	}
 
-	var prowClientset *prowclient.Clientset
-	if prowKubeconfig != "" {
-		prowClientset, err = prow.BuildClient(prowKubeconfig)
+	var prowDataProvider prow.DataProvider
+	if !config.ProwAuth.Configured() {
+		// Pull data anonymously. This doesn't utilize server-side job filtering.
+		prowDataProvider, err = prow.NewAnonymousDataProvider(config.ProwURI, config.ProwCAFile, config.ProwTimeout, selector)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		// Call to K8s API for Prow Jobs
+		restConfig, err := kube.RESTConfig(config.ProwAuth)
+		if err != nil {
+			return nil, errors.Wrap(err, "prow cluster")
+		}
+		kube.OnUnauthorized(restConfig, func() {
+			unauthorizedRequests.WithLabelValues(upstreamProw, prowURL.Host).Inc()
+		})
+		prowClientset, err := prow.BuildClient(restConfig)
+		if err != nil {
+			return nil, err
+		}
+		if config.ProwInformer {
+			// Serve from a watch-driven cache
+			prowDataProvider, err = prow.NewInformerDataProvider(prowClientset, prowInformerResync, selector)
+		} else {
+			prowDataProvider, err = prow.NewAuthenticatedDataProvier(prowClientset, selector)
+		}
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	return &Exporter{
-		prowURI:          prowURI,
-		vcenter:          vsphereHost,
-		vsphereHost:      vsphereHost,
-		vsphereUser:      vsphereUser,
-		vspherePasswd:    vspherePasswd,
-		vsphereUserAgent: vsphereUserAgent,
-		buildClientset:   buildClientset,
-		prowClientset:    prowClientset,
-		warningThreshold: warning,
+	// Test login with each vSphere. Refreshes retry the ones that failed.
+	for _, host := range vcenters {
+		err := vsphereSessions[host].Login(ctx)
+		if err != nil {
+			log.Error(errors.Wrapf(err, "failed logging in to vCenter %s, retrying on the next refresh", host))
+		}
+	}
+
+	e := &Exporter{
+		prowHost:               prowURL.Host,
+		vcenters:               vcenters,
+		vsphereSessions:        vsphereSessions,
+		buildClusters:          buildClusterNames,
+		buildResolvers:         buildResolvers,
+		fallbackCluster:        fallbackCluster,
+		prowDataProvider:       prowDataProvider,
+		warningThreshold:       config.WarningThreshold,
+		refreshInterval:        config.RefreshInterval,
+		phaseDuration:          phaseDuration,
+		phaseErrors:            phaseErrors,
+		namespaceDiscoveries:   namespaceDiscoveries,
+		resolutionCacheLookups: resolutionCacheLookups,
+		unauthorizedRequests:   unauthorizedRequests,
+		idleThreshold:          config.IdleThreshold,
+		jobLabels:              config.CorrelatedLabels,
+		jobInfo:                config.JobInfoMetric,
+		correlatedDesc:         newCorrelatedMetricDesc(config.CorrelatedLabels),
+		jobs:                   newJobTracker(config.PostJobGrace),
+		stop:                   make(chan struct{}),
+		done:                   make(chan struct{}),
 		totalScrapes: prometheus.NewCounter(prometheus.CounterOpts{
 			Namespace: namespace,
 			Name:      "exporter_scrapes_total",
 			Help:      "Current total scrapes",
 		}),
-		vcenterUp: prometheus.NewGauge(prometheus.GaugeOpts{
+		totalRefreshes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "refreshes_total",
+			Help:      "Current total refreshes of the snapshot served to scrapes.",
+		}),
+		vcenterUp: prometheus.NewGaugeVec(prometheus.GaugeOpts{
 			Namespace: namespace,
 			Name:      "vcenter_up",
 			Help:      "Was vCenter up last scrape.",
-		}),
-		prowUp: prometheus.NewGauge(prometheus.GaugeOpts{
+		}, []string{"vcenter"}),
+		prowUp: prometheus.NewGaugeVec(prometheus.GaugeOpts{
 			Namespace: namespace,
 			Name:      "prow_up",
 			Help:      "Was Prow up last scrape.",
-		}),
-	}, nil
+		}, []string{"prow"}),
+		buildUp: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "build_cluster_up",
+			Help:      "Was the build cluster up last scrape.",
+		}, []string{"build_cluster"}),
+		buildLookupErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "build_lookup_errors_total",
+			Help:      "Failed lookups of the CI users of jobs, by build cluster and reason.",
+		}, []string{"build_cluster", "reason"}),
+		lastUpstreamError: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "last_error_timestamp_seconds",
+			Help:      "Unix time an upstream last failed.",
+		}, []string{"upstream", "name"}),
+	}
+
+	// vCenters are down until the first refresh reaches them
+	for _, host := range vcenters {
+		e.vcenterUp.WithLabelValues(host).Set(0)
+	}
+
+	return e, nil
 }
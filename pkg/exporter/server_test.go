@@ -0,0 +1,265 @@
+package exporter
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/simulator"
+	"io/ioutil"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	prowapiv1 "k8s.io/test-infra/prow/apis/prowjobs/v1"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bostrt/vsphere-ci-session-metrics/pkg/service/build"
+	"github.com/bostrt/vsphere-ci-session-metrics/pkg/service/kube"
+	"github.com/bostrt/vsphere-ci-session-metrics/pkg/service/prow"
+	"github.com/bostrt/vsphere-ci-session-metrics/pkg/service/vsphere"
+)
+
+func Test_errorReason(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected string
+	}{
+		{errors.Wrap(build.ErrJobPodNotFound, "found 0 pods"), "pod_not_found"},
+		{errors.Wrap(build.ErrNamespaceNotInLogs, "no match"), "namespace_not_in_logs"},
+		{errors.WithStack(&build.PodLogsError{Pod: "ci/1234", Err: errors.New("container is waiting to start")}), "pod_logs_unavailable"},
+		{errors.Wrap(errors.Wrap(build.ErrSecretMissing, "not found"), "build-id 1234"), "secret_missing"},
+		{errors.Wrap(build.ErrUserNotParsed, "no username"), "user_not_parsed"},
+		{errors.Wrap(prow.ErrTargetNotFound, "build-id 1234"), "target_not_found"},
+		{errors.WithStack(&build.UnmonitoredVCenterError{VCenter: "vc2.example.com"}), "unmonitored_vcenter"},
+		{errors.Wrap(errUnknownBuildCluster, "cluster build05"), "unknown_build_cluster"},
+		{errors.Wrap(apierrors.NewUnauthorized("Unauthorized"), "unable to list pods"), "unauthorized"},
+		{errors.New("connection refused"), "other"},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, errorReason(test.err), test.err.Error())
+	}
+}
+
+func Test_Exporter_buildClusterFor(t *testing.T) {
+	e := &Exporter{
+		buildResolvers: map[string]*build.Resolver{"vsphere": nil, "build01": nil},
+	}
+	job := func(cluster string) prowapiv1.ProwJob {
+		return prowapiv1.ProwJob{Spec: prowapiv1.ProwJobSpec{Cluster: cluster}}
+	}
+
+	cluster, err := e.buildClusterFor(job("build01"))
+	assert.Nil(t, err)
+	assert.Equal(t, "build01", cluster)
+
+	_, err = e.buildClusterFor(job("build05"))
+	assert.True(t, errors.Is(err, errUnknownBuildCluster))
+
+	// Only a kubeconfig was given
+	e = &Exporter{
+		buildResolvers:  map[string]*build.Resolver{defaultBuildCluster: nil},
+		fallbackCluster: defaultBuildCluster,
+	}
+	cluster, err = e.buildClusterFor(job("vsphere"))
+	assert.Nil(t, err)
+	assert.Equal(t, defaultBuildCluster, cluster)
+}
+
+func Test_Exporter_listSharedUserIPs(t *testing.T) {
+	pod := func(name, namespace, ip string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+			Status:     corev1.PodStatus{PodIP: ip},
+		}
+	}
+	clientset := fake.NewSimpleClientset(
+		pod("e2e-vsphere", "ci-op-aaaaaaaa", "10.0.0.1"),
+		pod("e2e-vsphere", "ci-op-bbbbbbbb", "10.0.0.2"),
+		pod("e2e-vsphere", "ci-op-cccccccc", "10.0.0.3"),
+	)
+	e := &Exporter{
+		buildResolvers: map[string]*build.Resolver{"vsphere": build.NewResolver(clientset, build.ResolverConfig{})},
+	}
+
+	jobsByVCenter := map[string][]jobUser{
+		"vc1.example.com": {
+			{BuildID: "1", Username: "ci_user_01", BuildCluster: "vsphere", Namespace: "ci-op-aaaaaaaa"},
+			{BuildID: "2", Username: "ci_user_01", BuildCluster: "vsphere", Namespace: "ci-op-bbbbbbbb"},
+			{BuildID: "3", Username: "ci_user_02", BuildCluster: "vsphere", Namespace: "ci-op-cccccccc"},
+		},
+	}
+	e.listSharedUserIPs(jobsByVCenter)
+
+	jobs := jobsByVCenter["vc1.example.com"]
+	assert.Equal(t, map[string]bool{"10.0.0.1": true}, jobs[0].IPs)
+	assert.Equal(t, map[string]bool{"10.0.0.2": true}, jobs[1].IPs)
+	assert.Nil(t, jobs[2].IPs)
+
+	// The job with its own CI user had no pods listed
+	var listed []string
+	for _, action := range clientset.Actions() {
+		listed = append(listed, action.GetNamespace())
+	}
+	assert.ElementsMatch(t, []string{"ci-op-aaaaaaaa", "ci-op-bbbbbbbb"}, listed)
+}
+
+// testConfig returns the config of an exporter watching no vCenters, with a
+// build cluster that is never reached.
+func testConfig(t *testing.T) Config {
+	kubeconfig := filepath.Join(t.TempDir(), "kubeconfig")
+	err := ioutil.WriteFile(kubeconfig, []byte(`apiVersion: v1
+kind: Config
+clusters:
+- name: build01
+  cluster:
+    server: https://api.build01.example.com:6443
+users:
+- name: exporter
+  user:
+    token: s3cret
+contexts:
+- name: build01
+  context:
+    cluster: build01
+    user: exporter
+current-context: build01
+`), 0600)
+	assert.Nil(t, err)
+
+	return Config{
+		BuildAuth:    kube.AuthConfig{Kubeconfig: kubeconfig},
+		ProwURI:      "prow.example.com",
+		ProwSelector: prow.DefaultSelectorConfig(false),
+	}
+}
+
+func Test_NewExporter_VCenterDown(t *testing.T) {
+	config := testConfig(t)
+	config.VCenters = []VCenter{
+		{Host: "127.0.0.1:1", User: "exporter", Password: "s3cret"},
+	}
+
+	// Unreachable vCenters are retried by the refreshes
+	e, err := NewExporter(config)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"127.0.0.1:1"}, e.vcenters)
+	assert.Equal(t, float64(0), testutil.ToFloat64(e.vcenterUp.WithLabelValues("127.0.0.1:1")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(e.phaseErrors.WithLabelValues(phaseVCenterLogin, "other")))
+
+	// Configuration errors still fail
+	config.VCenters = append(config.VCenters, config.VCenters[0])
+	_, err = NewExporter(config)
+	assert.NotNil(t, err)
+}
+
+func Test_Exporter_observeBuildLookup(t *testing.T) {
+	e, err := NewExporter(testConfig(t))
+	assert.Nil(t, err)
+
+	e.observeBuildLookup("build01", time.Now(), nil)
+	e.observeBuildLookup("build01", time.Now(), errors.Wrap(build.ErrJobPodNotFound, "found 0 pods"))
+	e.observeBuildLookup("build05", time.Now(), errors.Wrap(errUnknownBuildCluster, "cluster build05"))
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(e.buildLookupErrors.WithLabelValues("build01", "pod_not_found")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(e.buildLookupErrors.WithLabelValues("build05", "unknown_build_cluster")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(e.phaseErrors.WithLabelValues(phaseBuildLookup, "pod_not_found")))
+}
+
+func Test_Exporter_Collect_CountsScrapes(t *testing.T) {
+	e, err := NewExporter(testConfig(t))
+	assert.Nil(t, err)
+
+	// Scrapes are served from the snapshot without refreshing it
+	testutil.CollectAndCount(e)
+	testutil.CollectAndCount(e)
+	assert.Equal(t, float64(2), testutil.ToFloat64(e.totalScrapes))
+	assert.Equal(t, float64(0), testutil.ToFloat64(e.totalRefreshes))
+}
+
+func Test_NewExporter_BadConfigLogsNoSessions(t *testing.T) {
+	ctx := context.TODO()
+
+	model := simulator.VPX()
+	defer model.Remove()
+	err := model.Create()
+	assert.Nil(t, err)
+	model.Service.TLS = new(tls.Config)
+	server := model.Service.NewServer()
+	defer server.Close()
+
+	password, _ := server.URL.User.Password()
+	vc := VCenter{Host: server.URL.Host, User: server.URL.User.Username(), Password: password, UserAgent: "exporter"}
+	tests := map[string]func(config *Config){
+		"duplicate vCenter": func(config *Config) { config.VCenters = append(config.VCenters, vc) },
+		"bad label":         func(config *Config) { config.CorrelatedLabels = []string{"bogus"} },
+		"bad build cluster": func(config *Config) { config.BuildClusters = []BuildCluster{{Name: "build01", Context: "build05"}} },
+		"bad prow URL":      func(config *Config) { config.ProwURI = "https://" },
+	}
+
+	admin, err := govmomi.NewClient(ctx, server.URL, true)
+	assert.Nil(t, err)
+	defer admin.Logout(ctx)
+
+	for name, breakConfig := range tests {
+		t.Run(name, func(t *testing.T) {
+			config := testConfig(t)
+			config.VCenters = []VCenter{vc}
+			breakConfig(&config)
+
+			_, err := NewExporter(config)
+			assert.NotNil(t, err)
+
+			users, err := vsphere.GetVsphereData(ctx, admin)
+			assert.Nil(t, err)
+			for _, s := range users.Sessions {
+				assert.NotEqual(t, "exporter", s.UserAgent)
+			}
+		})
+	}
+}
+
+// staticDataProvider always returns the same Prow jobs.
+type staticDataProvider []prowapiv1.ProwJob
+
+func (p staticDataProvider) GetData(ctx context.Context) ([]prowapiv1.ProwJob, error) {
+	return p, nil
+}
+
+func Test_Exporter_scrape_UnresolvedJobs(t *testing.T) {
+	model := simulator.VPX()
+	defer model.Remove()
+	err := model.Create()
+	assert.Nil(t, err)
+	model.Service.TLS = new(tls.Config)
+	server := model.Service.NewServer()
+	defer server.Close()
+
+	config := testConfig(t)
+	password, _ := server.URL.User.Password()
+	config.VCenters = []VCenter{{Host: server.URL.Host, User: server.URL.User.Username(), Password: password}}
+	e, err := NewExporter(config)
+	assert.Nil(t, err)
+	defer e.vsphereSessions[server.URL.Host].Logout(context.TODO())
+
+	// Neither job has a ci-operator target to look up
+	job := func(buildID string) prowapiv1.ProwJob {
+		return prowapiv1.ProwJob{
+			ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"prow.k8s.io/build-id": buildID}},
+			Spec:       prowapiv1.ProwJobSpec{Cluster: prow.VSphereClusterAlias},
+			Status:     prowapiv1.ProwJobStatus{State: prowapiv1.PendingState},
+		}
+	}
+	e.prowDataProvider = staticDataProvider{job("1"), job("2")}
+	e.buildResolvers[defaultBuildCluster] = build.NewResolver(fake.NewSimpleClientset(), build.ResolverConfig{})
+
+	snapshot := e.scrape()
+	assert.True(t, snapshot.JobsCorrelated)
+	assert.Equal(t, float64(2), snapshot.UnresolvedJobs)
+	assert.Equal(t, float64(2), testutil.ToFloat64(e.buildLookupErrors.WithLabelValues(defaultBuildCluster, "target_not_found")))
+}
@@ -0,0 +1,437 @@
+package exporter
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	prowapiv1 "k8s.io/test-infra/prow/apis/prowjobs/v1"
+
+	"github.com/bostrt/vsphere-ci-session-metrics/pkg/service/prow"
+	"github.com/bostrt/vsphere-ci-session-metrics/pkg/service/vsphere"
+)
+
+// Snapshot is an immutable view of the data gathered by a single refresh.
+// Collect only ever reads the latest Snapshot, so scrapes never wait on vCenter,
+// Prow or the build cluster.
+type Snapshot struct {
+	Timestamp      time.Time
+	VCenterUp      map[string]float64 // vCenter host => up
+	ProwUp         float64
+	BuildClusterUp map[string]float64 // build cluster name => up
+	Correlated     []CorrelatedSessions
+
+	// Sessions held by users without a running job. Only filled in when the
+	// Prow jobs could be listed.
+	Uncorrelated []UncorrelatedSessions
+
+	// Total sessions by vCenter
+	VCenterSessions map[string]float64
+
+	// Age and idle time of sessions by user and user agent
+	SessionTimes []SessionTimes
+
+	// Jobs skipped because they use a vCenter we don't monitor, by vCenter
+	UnmonitoredVCenterJobs map[string]float64
+
+	// Whether sessions were compared to running jobs, and how many running
+	// jobs' CI users couldn't be found. The sessions of those users look
+	// uncorrelated.
+	JobsCorrelated bool
+	UnresolvedJobs float64
+
+	// Sessions still held by the CI users of recently finished jobs
+	PostJob []PostJobSessions
+
+	// Selected Prow jobs, and how long the oldest pending one has been
+	// pending. Only filled in when the Prow jobs could be listed.
+	ProwJobs            []ProwJobCount
+	OldestPendingJobAge time.Duration
+
+	// Where running jobs install their clusters. Only filled in when the job
+	// info metric is enabled.
+	JobInfo []JobInfo
+}
+
+// JobInfo is a failure domain a running job installs its clusters in. Jobs
+// whose metadata.json has no failure domain have one with only the job's
+// fields set.
+type JobInfo struct {
+	Job           string
+	BuildID       string
+	Target        string
+	Username      string
+	VCenter       string
+	InfraID       string
+	FailureDomain string
+	Datacenter    string
+	Cluster       string
+	Datastore     string
+	Network       string
+}
+
+// ProwJobCount is the number of selected Prow jobs sharing a state, type,
+// repository and cluster alias.
+type ProwJobCount struct {
+	State        string
+	Type         string
+	Org          string
+	Repo         string
+	ClusterAlias string
+	Count        float64
+}
+
+// CorrelatedSessions is the number of sessions a CI user holds with a single
+// user agent while one of its Prow jobs is running.
+type CorrelatedSessions struct {
+	Username    string
+	UserAgent   string
+	Job         string
+	BuildID     string
+	PullRequest string
+	VCenter     string
+	Attribution string   // One of the Attribution* constants
+	ExtraLabels []string // Values of the opt-in labels, in configured order
+	Count       float64
+}
+
+// UncorrelatedSessions is the number of sessions a user holds with a single
+// user agent while none of its Prow jobs are running.
+type UncorrelatedSessions struct {
+	Username  string
+	UserAgent string
+	VCenter   string
+	Count     float64
+}
+
+// PostJobSessions is the number of sessions a CI user still holds with a
+// single user agent after its Prow job finished.
+type PostJobSessions struct {
+	Username  string
+	UserAgent string
+	Job       string
+	BuildID   string
+	JobState  string // Final state of the job, or JobStateUnknown
+	VCenter   string
+	Count     float64
+}
+
+// SessionTimes summarizes how old and how idle the sessions a user holds with a
+// single user agent are.
+type SessionTimes struct {
+	Username  string
+	UserAgent string
+	VCenter   string
+	Age       *histogram
+	Idle      *histogram
+
+	// Sessions idle for longer than the configured threshold
+	IdleSessions float64
+}
+
+// histogram is the data behind a constant Prometheus histogram.
+type histogram struct {
+	count   uint64
+	sum     float64
+	buckets map[float64]uint64 // upper bound => cumulative count
+}
+
+func newHistogram(bounds []float64) *histogram {
+	h := &histogram{
+		buckets: map[float64]uint64{},
+	}
+	for _, b := range bounds {
+		h.buckets[b] = 0
+	}
+	return h
+}
+
+func (h *histogram) observe(v float64) {
+	h.count++
+	h.sum += v
+	for b := range h.buckets {
+		if v <= b {
+			h.buckets[b]++
+		}
+	}
+}
+
+// Successful reports whether every upstream was reachable during the refresh.
+func (s *Snapshot) Successful() bool {
+	if len(s.VCenterUp) == 0 || s.ProwUp != 1 {
+		return false
+	}
+	for _, up := range s.VCenterUp {
+		if up != 1 {
+			return false
+		}
+	}
+	for _, up := range s.BuildClusterUp {
+		if up != 1 {
+			return false
+		}
+	}
+	return true
+}
+
+// collect sends the metrics of the snapshot to ch. correlatedDesc describes the
+// correlated metric, including its opt-in labels.
+func (s *Snapshot) collect(ch chan<- prometheus.Metric, correlatedDesc *prometheus.Desc) {
+	for _, c := range s.Correlated {
+		labelValues := []string{
+			c.Username,
+			c.UserAgent,
+			c.Job,
+			c.BuildID,
+			c.PullRequest,
+			c.VCenter,
+			c.Attribution,
+		}
+		ch <- prometheus.MustNewConstMetric(correlatedDesc,
+			correlatedMetricType,
+			c.Count,
+			append(labelValues, c.ExtraLabels...)...)
+	}
+
+	for _, u := range s.Uncorrelated {
+		ch <- prometheus.MustNewConstMetric(uncorrelatedMetricDesc,
+			prometheus.GaugeValue,
+			u.Count,
+			u.Username,
+			u.UserAgent,
+			u.VCenter)
+	}
+
+	for _, p := range s.PostJob {
+		ch <- prometheus.MustNewConstMetric(postJobMetricDesc,
+			prometheus.GaugeValue,
+			p.Count,
+			p.Username,
+			p.UserAgent,
+			p.Job,
+			p.BuildID,
+			p.JobState,
+			p.VCenter)
+	}
+
+	for _, t := range s.SessionTimes {
+		ch <- prometheus.MustNewConstHistogram(sessionAgeSecondsDesc,
+			t.Age.count,
+			t.Age.sum,
+			t.Age.buckets,
+			t.Username,
+			t.UserAgent,
+			t.VCenter)
+		ch <- prometheus.MustNewConstHistogram(sessionIdleSecondsDesc,
+			t.Idle.count,
+			t.Idle.sum,
+			t.Idle.buckets,
+			t.Username,
+			t.UserAgent,
+			t.VCenter)
+		ch <- prometheus.MustNewConstMetric(idleSessionsDesc,
+			prometheus.GaugeValue,
+			t.IdleSessions,
+			t.Username,
+			t.UserAgent,
+			t.VCenter)
+	}
+
+	for vcenter, count := range s.VCenterSessions {
+		ch <- prometheus.MustNewConstMetric(vcenterSessionsDesc,
+			prometheus.GaugeValue,
+			count,
+			vcenter)
+	}
+
+	for vcenter, count := range s.UnmonitoredVCenterJobs {
+		ch <- prometheus.MustNewConstMetric(unmonitoredVCenterJobsDesc,
+			prometheus.GaugeValue,
+			count,
+			vcenter)
+	}
+
+	for _, j := range s.JobInfo {
+		ch <- prometheus.MustNewConstMetric(jobInfoDesc,
+			prometheus.GaugeValue,
+			1,
+			j.Job,
+			j.BuildID,
+			j.Target,
+			j.Username,
+			j.VCenter,
+			j.InfraID,
+			j.FailureDomain,
+			j.Datacenter,
+			j.Cluster,
+			j.Datastore,
+			j.Network)
+	}
+
+	if s.JobsCorrelated {
+		ch <- prometheus.MustNewConstMetric(unresolvedJobsDesc,
+			prometheus.GaugeValue,
+			s.UnresolvedJobs)
+	}
+
+	if s.ProwUp == 1 {
+		for _, j := range s.ProwJobs {
+			ch <- prometheus.MustNewConstMetric(prowJobsDesc,
+				prometheus.GaugeValue,
+				j.Count,
+				j.State,
+				j.Type,
+				j.Org,
+				j.Repo,
+				j.ClusterAlias)
+		}
+		ch <- prometheus.MustNewConstMetric(oldestPendingJobAgeDesc,
+			prometheus.GaugeValue,
+			s.OldestPendingJobAge.Seconds())
+	}
+}
+
+// prowJobCounts counts jobs by state, type, repository and cluster alias, and
+// returns how long the oldest pending one has been pending as of now.
+func prowJobCounts(jobs []prowapiv1.ProwJob, now time.Time) ([]ProwJobCount, time.Duration) {
+	type key struct {
+		state, jobType, org, repo, clusterAlias string
+	}
+
+	counts := map[key]float64{}
+	var keys []key
+	var oldestPending time.Duration
+	for _, job := range jobs {
+		var org, repo string
+		if refs := prow.GetRefsFromJob(job); refs != nil {
+			org, repo = refs.Org, refs.Repo
+		}
+
+		k := key{string(job.Status.State), string(job.Spec.Type), org, repo, job.ClusterAlias()}
+		if _, ok := counts[k]; !ok {
+			keys = append(keys, k)
+		}
+		counts[k]++
+
+		if job.Status.State != prowapiv1.PendingState {
+			continue
+		}
+		pendingSince := job.Status.StartTime.Time
+		if job.Status.PendingTime != nil {
+			pendingSince = job.Status.PendingTime.Time
+		}
+		if age := now.Sub(pendingSince); age > oldestPending {
+			oldestPending = age
+		}
+	}
+
+	prowJobs := make([]ProwJobCount, 0, len(keys))
+	for _, k := range keys {
+		prowJobs = append(prowJobs, ProwJobCount{
+			State:        k.state,
+			Type:         k.jobType,
+			Org:          k.org,
+			Repo:         k.repo,
+			ClusterAlias: k.clusterAlias,
+			Count:        counts[k],
+		})
+	}
+	return prowJobs, oldestPending
+}
+
+// jobInfo lists the failure domains of each job.
+func jobInfo(jobs []jobUser) []JobInfo {
+	seen := map[JobInfo]bool{}
+	var info []JobInfo
+	add := func(i JobInfo) {
+		if !seen[i] {
+			seen[i] = true
+			info = append(info, i)
+		}
+	}
+
+	for _, job := range jobs {
+		i := JobInfo{
+			Job:      job.Job,
+			BuildID:  job.BuildID,
+			Target:   job.Target,
+			Username: job.Username,
+			VCenter:  job.VCenter,
+			InfraID:  job.InfraID,
+		}
+		if len(job.FailureDomains) == 0 {
+			add(i)
+			continue
+		}
+		for _, fd := range job.FailureDomains {
+			i.FailureDomain = fd.Name
+			i.Datacenter = fd.Datacenter
+			i.Cluster = fd.Cluster
+			i.Datastore = fd.Datastore
+			i.Network = fd.Network
+			add(i)
+		}
+	}
+	return info
+}
+
+// uncorrelatedSessions returns the sessions of every user in vsphereData that
+// isn't in correlatedUsers. Both are keyed by vCenter host.
+func uncorrelatedSessions(vsphereData map[string]*vsphere.VSphereUsers, correlatedUsers map[string]map[string]bool) []UncorrelatedSessions {
+	var uncorrelated []UncorrelatedSessions
+	for vcenter, v := range vsphereData {
+		v.ForEach(func(username string, userAgents map[string]float64) {
+			if correlatedUsers[vcenter][username] {
+				return
+			}
+			for userAgent, count := range userAgents {
+				uncorrelated = append(uncorrelated, UncorrelatedSessions{
+					Username:  username,
+					UserAgent: userAgent,
+					VCenter:   vcenter,
+					Count:     count,
+				})
+			}
+		})
+	}
+	return uncorrelated
+}
+
+// sessionTimes summarizes the age and idle time of every session in v, by user
+// and user agent.
+func sessionTimes(vcenter string, v *vsphere.VSphereUsers, idleThreshold time.Duration) []SessionTimes {
+	type key struct {
+		username  string
+		userAgent string
+	}
+
+	byUser := map[key]*SessionTimes{}
+	var keys []key
+	for _, s := range v.Sessions {
+		k := key{s.Username, s.UserAgent}
+		t, ok := byUser[k]
+		if !ok {
+			t = &SessionTimes{
+				Username:  s.Username,
+				UserAgent: s.UserAgent,
+				VCenter:   vcenter,
+				Age:       newHistogram(sessionTimeBuckets),
+				Idle:      newHistogram(sessionTimeBuckets),
+			}
+			byUser[k] = t
+			keys = append(keys, k)
+		}
+
+		idle := s.Idle(v.Now)
+		t.Age.observe(s.Age(v.Now).Seconds())
+		t.Idle.observe(idle.Seconds())
+		if idle > idleThreshold {
+			t.IdleSessions++
+		}
+	}
+
+	times := make([]SessionTimes, 0, len(keys))
+	for _, k := range keys {
+		times = append(times, *byUser[k])
+	}
+	return times
+}
@@ -0,0 +1,172 @@
+package exporter
+
+import (
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	prowapiv1 "k8s.io/test-infra/prow/apis/prowjobs/v1"
+	"testing"
+	"time"
+
+	"github.com/bostrt/vsphere-ci-session-metrics/pkg/service/build"
+	"github.com/bostrt/vsphere-ci-session-metrics/pkg/service/vsphere"
+)
+
+func Test_uncorrelatedSessions(t *testing.T) {
+	vsphereData := map[string]*vsphere.VSphereUsers{
+		"vc1.example.com": {
+			Mappings: map[string]map[string]float64{
+				"ci_user_01": {"govc": 2},
+				"ci_user_02": {"terraform": 3},
+			},
+		},
+		"vc2.example.com": {
+			Mappings: map[string]map[string]float64{
+				"ci_user_01": {"govc": 1},
+			},
+		},
+	}
+	correlatedUsers := map[string]map[string]bool{
+		"vc1.example.com": {"ci_user_01": true},
+	}
+
+	uncorrelated := uncorrelatedSessions(vsphereData, correlatedUsers)
+	assert.ElementsMatch(t, []UncorrelatedSessions{
+		{Username: "ci_user_02", UserAgent: "terraform", VCenter: "vc1.example.com", Count: 3},
+		{Username: "ci_user_01", UserAgent: "govc", VCenter: "vc2.example.com", Count: 1},
+	}, uncorrelated)
+}
+
+func Test_sessionTimes(t *testing.T) {
+	now := time.Date(2021, 12, 10, 14, 0, 0, 0, time.UTC)
+	v := &vsphere.VSphereUsers{
+		Now: now,
+		Sessions: []vsphere.UserSession{
+			{Username: "ci_user_01", UserAgent: "govc", LoginTime: now.Add(-2 * time.Hour), LastActiveTime: now.Add(-time.Hour)},
+			{Username: "ci_user_01", UserAgent: "govc", LoginTime: now.Add(-10 * time.Minute), LastActiveTime: now.Add(-30 * time.Second)},
+			{Username: "ci_user_02", UserAgent: "terraform", LoginTime: now.Add(-time.Minute), LastActiveTime: now},
+		},
+	}
+
+	times := sessionTimes("vc1.example.com", v, 30*time.Minute)
+	assert.Len(t, times, 2)
+
+	user1 := times[0]
+	assert.Equal(t, "ci_user_01", user1.Username)
+	assert.Equal(t, "vc1.example.com", user1.VCenter)
+	assert.Equal(t, uint64(2), user1.Age.count)
+	assert.Equal(t, float64(2*60*60+10*60), user1.Age.sum)
+	assert.Equal(t, uint64(1), user1.Age.buckets[15*60])
+	assert.Equal(t, uint64(2), user1.Age.buckets[2*60*60])
+	assert.Equal(t, uint64(1), user1.Idle.buckets[60])
+	assert.Equal(t, float64(1), user1.IdleSessions)
+
+	user2 := times[1]
+	assert.Equal(t, "terraform", user2.UserAgent)
+	assert.Equal(t, float64(0), user2.IdleSessions)
+}
+
+func Test_Snapshot_Successful(t *testing.T) {
+	s := &Snapshot{
+		VCenterUp:      map[string]float64{"vc1.example.com": 1, "vc2.example.com": 1},
+		ProwUp:         1,
+		BuildClusterUp: map[string]float64{"default": 1},
+	}
+	assert.True(t, s.Successful())
+
+	s.BuildClusterUp["default"] = 0
+	assert.False(t, s.Successful())
+
+	s.BuildClusterUp["default"] = 1
+	s.VCenterUp["vc2.example.com"] = 0
+	assert.False(t, s.Successful())
+}
+
+func Test_prowJobCounts(t *testing.T) {
+	now := time.Date(2022, 1, 1, 12, 0, 0, 0, time.UTC)
+	installer := &prowapiv1.Refs{Org: "openshift", Repo: "installer"}
+	jobs := []prowapiv1.ProwJob{
+		{
+			Spec: prowapiv1.ProwJobSpec{Type: prowapiv1.PresubmitJob, Cluster: "vsphere", Refs: installer},
+			Status: prowapiv1.ProwJobStatus{
+				State:       prowapiv1.PendingState,
+				StartTime:   metav1.Time{Time: now.Add(-time.Hour)},
+				PendingTime: &metav1.Time{Time: now.Add(-50 * time.Minute)},
+			},
+		},
+		{
+			Spec:   prowapiv1.ProwJobSpec{Type: prowapiv1.PresubmitJob, Cluster: "vsphere", Refs: installer},
+			Status: prowapiv1.ProwJobStatus{State: prowapiv1.PendingState, StartTime: metav1.Time{Time: now.Add(-10 * time.Minute)}},
+		},
+		{
+			Spec:   prowapiv1.ProwJobSpec{Type: prowapiv1.PeriodicJob, Cluster: "vsphere", ExtraRefs: []prowapiv1.Refs{{Org: "openshift", Repo: "release"}}},
+			Status: prowapiv1.ProwJobStatus{State: prowapiv1.TriggeredState, StartTime: metav1.Time{Time: now.Add(-2 * time.Hour)}},
+		},
+	}
+
+	counts, oldestPending := prowJobCounts(jobs, now)
+	assert.Equal(t, []ProwJobCount{
+		{State: "pending", Type: "presubmit", Org: "openshift", Repo: "installer", ClusterAlias: "vsphere", Count: 2},
+		{State: "triggered", Type: "periodic", Org: "openshift", Repo: "release", ClusterAlias: "vsphere", Count: 1},
+	}, counts)
+	assert.Equal(t, 50*time.Minute, oldestPending)
+}
+
+func Test_jobInfo(t *testing.T) {
+	jobs := []jobUser{
+		{
+			Job:      "periodic-ci-openshift-release-master-nightly-4.10-e2e-vsphere",
+			BuildID:  "1234",
+			Target:   "e2e-vsphere",
+			Username: "ci_user_01",
+			VCenter:  "vc1.example.com",
+			InfraID:  "ci-op-9nmljnxm-x7k2p",
+			FailureDomains: []build.FailureDomain{
+				{Name: "us-east-1", Datacenter: "dc1", Cluster: "/dc1/host/cluster1", Datastore: "/dc1/datastore/ds1", Network: "ci-segment-151"},
+				{Name: "us-east-2", Datacenter: "dc1", Cluster: "/dc1/host/cluster2", Datastore: "/dc1/datastore/ds2", Network: "ci-segment-151"},
+			},
+		},
+		{
+			Job:      "pull-ci-openshift-installer-master-e2e-vsphere",
+			BuildID:  "5678",
+			Target:   "e2e-vsphere",
+			Username: "ci_user_02",
+			VCenter:  "vc1.example.com",
+		},
+	}
+
+	assert.Equal(t, []JobInfo{
+		{
+			Job:           "periodic-ci-openshift-release-master-nightly-4.10-e2e-vsphere",
+			BuildID:       "1234",
+			Target:        "e2e-vsphere",
+			Username:      "ci_user_01",
+			VCenter:       "vc1.example.com",
+			InfraID:       "ci-op-9nmljnxm-x7k2p",
+			FailureDomain: "us-east-1",
+			Datacenter:    "dc1",
+			Cluster:       "/dc1/host/cluster1",
+			Datastore:     "/dc1/datastore/ds1",
+			Network:       "ci-segment-151",
+		},
+		{
+			Job:           "periodic-ci-openshift-release-master-nightly-4.10-e2e-vsphere",
+			BuildID:       "1234",
+			Target:        "e2e-vsphere",
+			Username:      "ci_user_01",
+			VCenter:       "vc1.example.com",
+			InfraID:       "ci-op-9nmljnxm-x7k2p",
+			FailureDomain: "us-east-2",
+			Datacenter:    "dc1",
+			Cluster:       "/dc1/host/cluster2",
+			Datastore:     "/dc1/datastore/ds2",
+			Network:       "ci-segment-151",
+		},
+		{
+			Job:      "pull-ci-openshift-installer-master-e2e-vsphere",
+			BuildID:  "5678",
+			Target:   "e2e-vsphere",
+			Username: "ci_user_02",
+			VCenter:  "vc1.example.com",
+		},
+	}, jobInfo(append(jobs, jobs[1])))
+}
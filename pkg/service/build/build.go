@@ -1,7 +1,7 @@
 package build
 
 import (
-	"bytes"
+	"bufio"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -9,111 +9,606 @@ import (
 	log "github.com/sirupsen/logrus"
 	"io"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/rest"
 	"regexp"
+	"sort"
+	"strings"
+	"time"
 )
 
 var (
 	UsingNamespaceRegex = regexp.MustCompile(`.*Using namespace .*/(ci-op-........)`)
 )
 
+const (
+	// Labels ci-operator puts on the pods it creates in a job's namespace
+	CreatedByCILabel    = "created-by-ci"
+	DefaultBuildIDLabel = "build-id"
+
+	// Prefix of the namespaces ci-operator runs jobs in
+	CINamespacePrefix = "ci-op-"
+
+	// Container of the job pod running ci-operator, and how much of its log
+	// is read. The namespace is logged within the first few lines.
+	DefaultLogContainer  = "test"
+	DefaultLogLimitBytes = 1 << 20
+)
+
+// Ways of finding the ci-op-* namespace of a job
+const (
+	NamespaceStrategyLabels = "labels"
+	NamespaceStrategyLogs   = "logs"
+)
+
+// Reasons resolving a CI user can fail. Returned errors wrap one of these, or
+// are an *UnmonitoredVCenterError or a *PodLogsError.
+var (
+	ErrJobPodNotFound     = errors.New("job pod not found")
+	ErrNamespaceNotInLogs = errors.New("ci-op namespace not found in logs")
+	ErrSecretMissing      = errors.New("cluster profile secret missing")
+	ErrUserNotParsed      = errors.New("CI user not parsed from metadata.json")
+)
+
+// Metadata is the metadata.json of a vSphere cluster profile. Older profiles
+// describe a single vCenter right under vsphere, newer ones list vCenters and
+// the failure domains clusters are installed in.
 type Metadata struct {
+	InfraID string `json:"infraID"`
 	VSphere struct {
-		VCenter string `json:"vCenter"`
-		Username string `json:"username"`
+		// Single vCenter schema
+		VCenter    string `json:"vCenter"`
+		Username   string `json:"username"`
+		Datacenter string `json:"datacenter"`
+		Cluster    string `json:"cluster"`
+		Datastore  string `json:"defaultDatastore"`
+		Network    string `json:"network"`
+
+		// Multi vCenter schema
+		VCenters       []MetadataVCenter       `json:"vcenters"`
+		FailureDomains []MetadataFailureDomain `json:"failureDomains"`
 	} `json:"vsphere"`
 }
 
-func BuildClient(kubeconfig string) (*kubernetes.Clientset, error) {
-	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
-	if err != nil {
-		return nil, err
+// MetadataVCenter is a vCenter of the multi vCenter schema. The installer
+// names the fields vCenter and username rather than server and user.
+type MetadataVCenter struct {
+	Server   string `json:"server"`
+	VCenter  string `json:"vCenter"`
+	User     string `json:"user"`
+	Username string `json:"username"`
+}
+
+// MetadataFailureDomain is a failure domain of the multi vCenter schema.
+type MetadataFailureDomain struct {
+	Name     string `json:"name"`
+	Server   string `json:"server"`
+	Topology struct {
+		Datacenter     string   `json:"datacenter"`
+		ComputeCluster string   `json:"computeCluster"`
+		Datastore      string   `json:"datastore"`
+		Networks       []string `json:"networks"`
+	} `json:"topology"`
+}
+
+// CIUser is the vSphere user a CI job target was handed, and the vCenter it is
+// for.
+type CIUser struct {
+	Username  string
+	VCenter   string
+	Namespace string // ci-op-* namespace the job runs its tests in
+	Target    string // ci-operator target whose cluster profile names the user
+
+	// Where the job installs its clusters on VCenter, if metadata.json says
+	InfraID        string
+	FailureDomains []FailureDomain
+}
+
+// FailureDomain is where on a vCenter a job installs its clusters. Single
+// vCenter profiles have one without a Name.
+type FailureDomain struct {
+	Name       string
+	Datacenter string
+	Cluster    string
+	Datastore  string
+	Network    string
+}
+
+// UnmonitoredVCenterError is returned when a job's metadata.json names a
+// vCenter that isn't one of the accepted vCenters.
+type UnmonitoredVCenterError struct {
+	VCenter string
+}
+
+func (e *UnmonitoredVCenterError) Error() string {
+	return fmt.Sprintf("job uses vCenter %s which is not monitored", e.VCenter)
+}
+
+// PodLogsError is returned when the logs of a job pod couldn't be read, e.g.
+// because the pod hasn't started yet or was deleted.
+type PodLogsError struct {
+	Pod string // namespace/name
+	Err error
+}
+
+func (e *PodLogsError) Error() string {
+	return fmt.Sprintf("unable to read logs of pod %s: %s", e.Pod, e.Err)
+}
+
+func (e *PodLogsError) Unwrap() error {
+	return e.Err
+}
+
+// ResolverConfig holds the settings of a Resolver.
+type ResolverConfig struct {
+	VCenters []string // Accepted vCenter hosts
+
+	// Label ci-operator puts the build ID in on the pods of a job. Defaults to
+	// DefaultBuildIDLabel.
+	BuildIDLabel string
+
+	// Where the ci-op-* namespace is looked for in the logs of a job pod, when
+	// it can't be found from labels. Default to DefaultLogContainer,
+	// UsingNamespaceRegex and DefaultLogLimitBytes.
+	LogContainer   string
+	NamespaceRegex *regexp.Regexp
+	LogLimitBytes  int64
+
+	// How long resolved jobs, and jobs that failed to resolve, are cached.
+	// Nothing is cached when both are zero.
+	CacheTTL         time.Duration
+	NegativeCacheTTL time.Duration
+}
+
+// Resolver finds the CI user of Prow jobs by looking at the build cluster.
+type Resolver struct {
+	clientset    kubernetes.Interface
+	vcenters     map[string]bool // Accepted vCenter hosts
+	buildIDLabel string
+
+	logContainer   string
+	namespaceRegex *regexp.Regexp
+	logLimitBytes  int64
+
+	cache *resolutionCache
+
+	// OnNamespaceFound, if set, is called with the strategy that found each
+	// job's ci-op-* namespace
+	OnNamespaceFound func(strategy string)
+
+	// OnCacheLookup, if set, is called with the result of each cache lookup
+	OnCacheLookup func(result string)
+}
+
+func NewResolver(clientset kubernetes.Interface, config ResolverConfig) *Resolver {
+	r := &Resolver{
+		clientset:      clientset,
+		vcenters:       map[string]bool{},
+		buildIDLabel:   config.BuildIDLabel,
+		logContainer:   config.LogContainer,
+		namespaceRegex: config.NamespaceRegex,
+		logLimitBytes:  config.LogLimitBytes,
 	}
+	if r.buildIDLabel == "" {
+		r.buildIDLabel = DefaultBuildIDLabel
+	}
+	if r.logContainer == "" {
+		r.logContainer = DefaultLogContainer
+	}
+	if r.namespaceRegex == nil {
+		r.namespaceRegex = UsingNamespaceRegex
+	}
+	if r.logLimitBytes == 0 {
+		r.logLimitBytes = DefaultLogLimitBytes
+	}
+	if config.CacheTTL > 0 || config.NegativeCacheTTL > 0 {
+		r.cache = newResolutionCache(config.CacheTTL, config.NegativeCacheTTL)
+	}
+	for _, vc := range config.VCenters {
+		r.vcenters[vc] = true
+	}
+	return r
+}
+
+// BuildClient creates a clientset for a build cluster. See kube.RESTConfig
+// for building config.
+func BuildClient(config *rest.Config) (*kubernetes.Clientset, error) {
 	clientset, err := kubernetes.NewForConfig(config)
 
 	return clientset, err
 }
 
-func GetCIUserForBuildID(buildID string, target string, clientset *kubernetes.Clientset) (string, error) {
-	labelSelector := fmt.Sprintf("prow.k8s.io/build-id=%s", buildID)
+// GetCIUsersForBuildID returns the CI user of each target of the job with the
+// given build ID. Each target has its own cluster profile secret. Targets that
+// can't be resolved are skipped, unless none can, in which case the first
+// target's error is returned. An *UnmonitoredVCenterError is returned for
+// targets that use a vCenter that isn't accepted by the Resolver.
+//
+// Results, including failures, are cached by build ID when the Resolver has a
+// cache.
+func (r *Resolver) GetCIUsersForBuildID(buildID string, targets []string) ([]*CIUser, error) {
+	if r.cache == nil {
+		return r.resolve(buildID, targets)
+	}
 
-	log.Debugf("looking for pods in ci namespace with label selector: %s", labelSelector)
-	podList, err := clientset.CoreV1().Pods("ci").List(context.TODO(), metav1.ListOptions{
-		LabelSelector: labelSelector,
-	})
+	if entry, ok := r.cache.get(buildID); ok {
+		if entry.err != nil {
+			r.cacheLookup(CacheNegativeHit)
+		} else {
+			r.cacheLookup(CacheHit)
+		}
+		return entry.users, entry.err
+	}
+	r.cacheLookup(CacheMiss)
+
+	users, err := r.resolve(buildID, targets)
+	r.cache.put(buildID, users, err)
+	return users, err
+}
+
+// Forget evicts every job that isn't in buildIDs from the cache. It should be
+// called with the jobs still running.
+func (r *Resolver) Forget(buildIDs map[string]bool) {
+	if r.cache != nil {
+		r.cache.retain(buildIDs)
+	}
+}
+
+// CacheSize returns how many jobs are in the cache.
+func (r *Resolver) CacheSize() int {
+	if r.cache == nil {
+		return 0
+	}
+	return r.cache.len()
+}
+
+func (r *Resolver) cacheLookup(result string) {
+	if r.OnCacheLookup != nil {
+		r.OnCacheLookup(result)
+	}
+}
+
+func (r *Resolver) resolve(buildID string, targets []string) ([]*CIUser, error) {
+	ns, err := r.getCiNamespace(buildID)
+	if err != nil {
+		return nil, err
+	}
+
+	var users []*CIUser
+	var firstErr error
+	for _, target := range targets {
+		targetUsers, err := r.getCIUsersForTarget(buildID, target, ns)
+		if err != nil {
+			log.Debugf("build-id %s target %s: %s", buildID, target, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		users = append(users, targetUsers...)
+	}
+
+	if len(users) == 0 {
+		return nil, firstErr
+	}
+	return users, nil
+}
+
+// getCIUsersForTarget returns the CI users of a target on each accepted
+// vCenter. Multi vCenter cluster profiles have a CI user per vCenter.
+func (r *Resolver) getCIUsersForTarget(buildID string, target string, ns string) ([]*CIUser, error) {
+	users, err := getCIUsersFromSecret(r.clientset, target, ns)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to find secret for build-id %s", buildID)
+	}
+
+	var accepted []*CIUser
+	for _, user := range users {
+		if !r.vcenters[user.VCenter] {
+			log.Debugf("build-id %s target %s: skipping unmonitored vCenter %s", buildID, target, user.VCenter)
+			continue
+		}
+		user.Namespace = ns
+		user.Target = target
+		accepted = append(accepted, user)
+	}
+
+	if len(accepted) == 0 {
+		return nil, errors.WithStack(&UnmonitoredVCenterError{VCenter: users[0].VCenter})
+	}
+	return accepted, nil
+}
+
+// Ping checks that the build cluster's API is reachable.
+func (r *Resolver) Ping() error {
+	_, err := r.clientset.Discovery().ServerVersion()
+	return err
+}
+
+// GetPodIPs returns the IPs of every pod in a job's ci-op-* namespace. These
+// are the addresses the job's vSphere clients connect from.
+func (r *Resolver) GetPodIPs(namespace string) ([]string, error) {
+	podList, err := r.clientset.CoreV1().Pods(namespace).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to list pods in %s", namespace)
+	}
+
+	return getPodIPs(podList.Items), nil
+}
+
+// getCiNamespace finds the ci-op-* namespace of the job with the given build
+// ID. The labels of the pods ci-operator created for the job are looked at
+// first, the job pod's logs are only read when that fails.
+func (r *Resolver) getCiNamespace(buildID string) (string, error) {
+	ns, err := r.getCiNamespaceFromLabels(buildID)
+	if err == nil {
+		r.namespaceFound(NamespaceStrategyLabels)
+		return ns, nil
+	}
+	log.Debugf("build-id %s: %s, falling back to pod logs", buildID, err)
+
+	ns, err = r.getCiNamespaceFromLogs(buildID)
 	if err != nil {
 		return "", err
 	}
+	r.namespaceFound(NamespaceStrategyLogs)
+	return ns, nil
+}
 
-	if len(podList.Items) != 1 {
-		return "", errors.Wrap(err, "found multiple pods with same build-id annotation")
+func (r *Resolver) namespaceFound(strategy string) {
+	if r.OnNamespaceFound != nil {
+		r.OnNamespaceFound(strategy)
 	}
+}
 
-	log.Debugf("found %d pod[s] for build id %s", len(podList.Items), buildID)
+// getCiNamespaceFromLabels looks for pods ci-operator created for the job in
+// any ci-op-* namespace.
+//
+// ci-operator doesn't put the build ID on the namespace itself, so pods are
+// listed. ResourceVersion "0" has the API server answer from its watch cache
+// rather than with a quorum read from etcd. It still filters every pod in the
+// cluster in memory, which is why results are cached by build ID.
+func (r *Resolver) getCiNamespaceFromLabels(buildID string) (string, error) {
+	labelSelector := fmt.Sprintf("%s=true,%s=%s", CreatedByCILabel, r.buildIDLabel, buildID)
 
-	jobPod := podList.Items[0]
-	ns, err := getCiNamespaceFromPod(clientset, jobPod)
+	log.Debugf("looking for pods in all namespaces with label selector: %s", labelSelector)
+	podList, err := r.clientset.CoreV1().Pods(metav1.NamespaceAll).List(context.TODO(), metav1.ListOptions{
+		LabelSelector:   labelSelector,
+		ResourceVersion: "0",
+	})
 	if err != nil {
 		return "", err
 	}
 
-	user, err := getCIUserFromSecret(clientset, target, ns)
+	for _, pod := range podList.Items {
+		if strings.HasPrefix(pod.Namespace, CINamespacePrefix) {
+			return pod.Namespace, nil
+		}
+	}
+	return "", fmt.Errorf("no ci-op-* pods labeled with build-id %s", buildID)
+}
+
+// getCiNamespaceFromLogs reads the namespace from the logs of the job pod.
+func (r *Resolver) getCiNamespaceFromLogs(buildID string) (string, error) {
+	labelSelector := fmt.Sprintf("prow.k8s.io/build-id=%s", buildID)
+
+	log.Debugf("looking for pods in ci namespace with label selector: %s", labelSelector)
+	podList, err := r.clientset.CoreV1().Pods("ci").List(context.TODO(), metav1.ListOptions{
+		LabelSelector: labelSelector,
+	})
 	if err != nil {
-		return "", errors.Wrapf(err, "unable to find secret for build-id %s", buildID)
+		return "", err
+	}
+
+	if len(podList.Items) == 0 {
+		return "", errors.Wrapf(ErrJobPodNotFound, "no pods with build-id %s", buildID)
 	}
 
-	return user, nil
+	log.Debugf("found %d pod[s] for build id %s", len(podList.Items), buildID)
+
+	// A job's pod is recreated when it is retried. Each pod is tried in turn,
+	// and the error of the first one is returned if none has the namespace.
+	var firstErr error
+	for _, pod := range orderJobPods(podList.Items) {
+		ns, err := getCiNamespaceFromPod(r.clientset, pod, r.logContainer, r.logLimitBytes, r.namespaceRegex)
+		if err == nil {
+			return ns, nil
+		}
+		log.Debugf("build-id %s pod %s: %s", buildID, pod.Name, err)
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return "", firstErr
 }
 
-func getCiNamespaceFromPod(clientset *kubernetes.Clientset, jobPod corev1.Pod) (string, error) {
-	req := clientset.CoreV1().Pods(jobPod.Namespace).GetLogs(jobPod.Name, &corev1.PodLogOptions{
-		Container:                    "test",
+// orderJobPods sorts the pods of a job so that running pods come first, newest
+// first.
+func orderJobPods(pods []corev1.Pod) []corev1.Pod {
+	ordered := make([]corev1.Pod, len(pods))
+	copy(ordered, pods)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		iRunning := ordered[i].Status.Phase == corev1.PodRunning
+		jRunning := ordered[j].Status.Phase == corev1.PodRunning
+		if iRunning != jRunning {
+			return iRunning
+		}
+		return ordered[j].CreationTimestamp.Before(&ordered[i].CreationTimestamp)
 	})
+	return ordered
+}
+
+func getCiNamespaceFromPod(clientset kubernetes.Interface, jobPod corev1.Pod, container string, limitBytes int64, regex *regexp.Regexp) (string, error) {
+	opts := &corev1.PodLogOptions{
+		Container: container,
+	}
+	if limitBytes > 0 {
+		opts.LimitBytes = &limitBytes
+	}
+	req := clientset.CoreV1().Pods(jobPod.Namespace).GetLogs(jobPod.Name, opts)
 
 	podLogs, err := req.Stream(context.TODO())
 	if err != nil {
-		return "", err
+		return "", errors.WithStack(&PodLogsError{Pod: jobPod.Namespace + "/" + jobPod.Name, Err: err})
 	}
 	defer podLogs.Close()
 
-	buf := new(bytes.Buffer)
-	_, err = io.Copy(buf, podLogs)
-	if err != nil {
-		return "", err
+	var r io.Reader = podLogs
+	if limitBytes > 0 {
+		// Not every API server honors LimitBytes
+		r = io.LimitReader(r, limitBytes)
 	}
-
-	str := buf.String()
-	return getCiNamespaceFromPodLogs(str)
+	ns, err := getCiNamespaceFromPodLogs(r, regex)
+	if err != nil && !errors.Is(err, ErrNamespaceNotInLogs) {
+		return "", errors.WithStack(&PodLogsError{Pod: jobPod.Namespace + "/" + jobPod.Name, Err: err})
+	}
+	return ns, err
 }
 
-func getCiNamespaceFromPodLogs(logs string) (string, error) {
-	matches := UsingNamespaceRegex.FindStringSubmatch(logs)
-	if matches == nil {
-		return "", fmt.Errorf("unable to find any matching ci-op-* namespace in logs")
+// getCiNamespaceFromPodLogs scans logs line by line, and stops at the first
+// line regex matches. The first submatch of regex is the namespace.
+func getCiNamespaceFromPodLogs(logs io.Reader, regex *regexp.Regexp) (string, error) {
+	reader := bufio.NewReader(logs)
+	for {
+		line, err := reader.ReadString('\n')
+		if matches := regex.FindStringSubmatch(line); matches != nil {
+			return matches[1], nil
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
 	}
 
-	return matches[1], nil
+	return "", errors.Wrap(ErrNamespaceNotInLogs, "unable to find any matching ci-op-* namespace in logs")
+}
+
+// ParseNamespaceRegex compiles a regex that finds the ci-op-* namespace in
+// the logs of a job pod. Its first submatch must be the namespace.
+func ParseNamespaceRegex(expr string) (*regexp.Regexp, error) {
+	regex, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid namespace regex")
+	}
+	if regex.NumSubexp() < 1 {
+		return nil, fmt.Errorf("namespace regex %q has no submatch for the namespace", expr)
+	}
+	return regex, nil
 }
-func getCIUserFromSecret(clientset *kubernetes.Clientset, secretName string, namespace string) (string, error) {
+
+func getCIUsersFromSecret(clientset kubernetes.Interface, secretName string, namespace string) ([]*CIUser, error) {
 	secret, err := clientset.CoreV1().Secrets(namespace).Get(context.TODO(), secretName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, errors.Wrapf(ErrSecretMissing, "secret %s/%s not found", namespace, secretName)
+	}
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	for key,value := range secret.Data {
 		if key == "metadata.json" {
-			m := Metadata{}
-			err = json.Unmarshal(value, &m)
-			if err != nil {
-				return "", errors.Wrap(err, "error unmarshalling metadata.json")
+			return getCIUsersFromMetadata(value)
+		}
+	}
+	return nil, errors.Wrapf(ErrSecretMissing, "no metadata.json in secret %s/%s", namespace, secretName)
+}
+
+// getCIUsersFromMetadata returns a CI user per vCenter in metadata.json, in
+// the order they are listed.
+func getCIUsersFromMetadata(data []byte) ([]*CIUser, error) {
+	m := Metadata{}
+	err := json.Unmarshal(data, &m)
+	if err != nil {
+		return nil, errors.Wrapf(ErrUserNotParsed, "error unmarshalling metadata.json: %s", err)
+	}
+
+	if len(m.VSphere.VCenters) == 0 {
+		// Single vCenter schema
+		if m.VSphere.Username == "" {
+			return nil, errors.Wrap(ErrUserNotParsed, "no vsphere username in metadata.json")
+		}
+
+		user := &CIUser{
+			Username: m.VSphere.Username,
+			VCenter:  m.VSphere.VCenter,
+			InfraID:  m.InfraID,
+		}
+		fd := FailureDomain{
+			Datacenter: m.VSphere.Datacenter,
+			Cluster:    m.VSphere.Cluster,
+			Datastore:  m.VSphere.Datastore,
+			Network:    m.VSphere.Network,
+		}
+		if fd != (FailureDomain{}) {
+			user.FailureDomains = []FailureDomain{fd}
+		}
+		return []*CIUser{user}, nil
+	}
+
+	var users []*CIUser
+	for _, vc := range m.VSphere.VCenters {
+		server := vc.Server
+		if server == "" {
+			server = vc.VCenter
+		}
+		username := vc.User
+		if username == "" {
+			username = vc.Username
+		}
+		if username == "" {
+			log.Debugf("no vsphere username for vCenter %s in metadata.json", server)
+			continue
+		}
+
+		user := &CIUser{
+			Username: username,
+			VCenter:  server,
+			InfraID:  m.InfraID,
+		}
+		for _, fd := range m.VSphere.FailureDomains {
+			// Failure domains without a server are on the only vCenter
+			if fd.Server != server && (fd.Server != "" || len(m.VSphere.VCenters) > 1) {
+				continue
 			}
-			if m.VSphere.VCenter == "ibmvcenter.vmc-ci.devcluster.openshift.com" { // TODO Probably filter this somewhere more obvious
-				return m.VSphere.Username, nil
+			var network string
+			if len(fd.Topology.Networks) > 0 {
+				// The installer only supports one network per failure domain
+				network = fd.Topology.Networks[0]
 			}
+			user.FailureDomains = append(user.FailureDomains, FailureDomain{
+				Name:       fd.Name,
+				Datacenter: fd.Topology.Datacenter,
+				Cluster:    fd.Topology.ComputeCluster,
+				Datastore:  fd.Topology.Datastore,
+				Network:    network,
+			})
+		}
+		users = append(users, user)
+	}
+
+	if len(users) == 0 {
+		return nil, errors.Wrap(ErrUserNotParsed, "no vsphere username in metadata.json")
+	}
+	return users, nil
+}
+
+func getPodIPs(pods []corev1.Pod) []string {
+	var ips []string
+	for _, pod := range pods {
+		if pod.Spec.HostNetwork {
+			// Shares the node's address with every other job on it
+			continue
+		}
+		if len(pod.Status.PodIPs) == 0 && pod.Status.PodIP != "" {
+			ips = append(ips, pod.Status.PodIP)
+		}
+		for _, ip := range pod.Status.PodIPs {
+			ips = append(ips, ip.IP)
 		}
 	}
-	log.Debugf("unable to find CI user from secret %s/%s", namespace, secretName)
-	return "", nil
+	return ips
 }
@@ -1,8 +1,18 @@
 package build
 
 import (
+	"context"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
+	"io"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"regexp"
+	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
 )
 
 const (
@@ -21,13 +31,382 @@ INFO[2021-12-10T14:28:50Z] Resolved release latest to registry.ci.openshift.org/
 )
 
 func Test_getCiNamespaceFromPodLogs_Good(t *testing.T) {
-	result, err := getCiNamespaceFromPodLogs(GoodLog)
+	result, err := getCiNamespaceFromPodLogs(strings.NewReader(GoodLog), UsingNamespaceRegex)
 	assert.Nil(t, err)
 	assert.Equal(t, "ci-op-9nmljnxm", result)
 }
 
 func Test_getCiNamespaceFromPodLogs_Bad(t *testing.T) {
-	result, err := getCiNamespaceFromPodLogs(BadLog)
+	result, err := getCiNamespaceFromPodLogs(strings.NewReader(BadLog), UsingNamespaceRegex)
 	assert.NotNil(t, err)
 	assert.Zero(t, len(result))
 }
+
+func Test_getCIUsersFromMetadata(t *testing.T) {
+	users, err := getCIUsersFromMetadata([]byte(`{"vsphere":{"vCenter":"vc1.example.com","username":"ci_user_01@vsphere.local"}}`))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(users))
+	assert.Equal(t, "ci_user_01@vsphere.local", users[0].Username)
+	assert.Equal(t, "vc1.example.com", users[0].VCenter)
+	assert.Nil(t, users[0].FailureDomains)
+}
+
+func Test_getCIUsersFromMetadata_Legacy(t *testing.T) {
+	users, err := getCIUsersFromMetadata([]byte(`{
+		"clusterName": "ci-op-9nmljnxm",
+		"infraID": "ci-op-9nmljnxm-x7k2p",
+		"vsphere": {
+			"vCenter": "vc1.example.com",
+			"username": "ci_user_01@vsphere.local",
+			"datacenter": "IBMCloud",
+			"cluster": "vcs-ci-workload",
+			"defaultDatastore": "vsanDatastore",
+			"network": "ci-segment-151"
+		}
+	}`))
+	assert.Nil(t, err)
+	assert.Equal(t, []*CIUser{{
+		Username: "ci_user_01@vsphere.local",
+		VCenter:  "vc1.example.com",
+		InfraID:  "ci-op-9nmljnxm-x7k2p",
+		FailureDomains: []FailureDomain{{
+			Datacenter: "IBMCloud",
+			Cluster:    "vcs-ci-workload",
+			Datastore:  "vsanDatastore",
+			Network:    "ci-segment-151",
+		}},
+	}}, users)
+}
+
+func Test_getCIUsersFromMetadata_MultiVCenter(t *testing.T) {
+	users, err := getCIUsersFromMetadata([]byte(`{
+		"infraID": "ci-op-9nmljnxm-x7k2p",
+		"vsphere": {
+			"vcenters": [
+				{"server": "vc1.example.com", "user": "ci_user_01@vsphere.local", "datacenters": ["dc1"]},
+				{"server": "vc2.example.com", "user": "ci_user_02@vsphere.local", "datacenters": ["dc2"]}
+			],
+			"failureDomains": [
+				{
+					"name": "us-east-1",
+					"server": "vc1.example.com",
+					"topology": {
+						"datacenter": "dc1",
+						"computeCluster": "/dc1/host/cluster1",
+						"datastore": "/dc1/datastore/ds1",
+						"networks": ["ci-segment-151"]
+					}
+				},
+				{
+					"name": "us-east-2",
+					"server": "vc1.example.com",
+					"topology": {"datacenter": "dc1", "computeCluster": "/dc1/host/cluster2", "datastore": "/dc1/datastore/ds2"}
+				},
+				{
+					"name": "us-west-1",
+					"server": "vc2.example.com",
+					"topology": {"datacenter": "dc2", "computeCluster": "/dc2/host/cluster1", "datastore": "/dc2/datastore/ds1", "networks": ["ci-segment-152"]}
+				}
+			]
+		}
+	}`))
+	assert.Nil(t, err)
+	assert.Equal(t, []*CIUser{
+		{
+			Username: "ci_user_01@vsphere.local",
+			VCenter:  "vc1.example.com",
+			InfraID:  "ci-op-9nmljnxm-x7k2p",
+			FailureDomains: []FailureDomain{
+				{Name: "us-east-1", Datacenter: "dc1", Cluster: "/dc1/host/cluster1", Datastore: "/dc1/datastore/ds1", Network: "ci-segment-151"},
+				{Name: "us-east-2", Datacenter: "dc1", Cluster: "/dc1/host/cluster2", Datastore: "/dc1/datastore/ds2"},
+			},
+		},
+		{
+			Username: "ci_user_02@vsphere.local",
+			VCenter:  "vc2.example.com",
+			InfraID:  "ci-op-9nmljnxm-x7k2p",
+			FailureDomains: []FailureDomain{
+				{Name: "us-west-1", Datacenter: "dc2", Cluster: "/dc2/host/cluster1", Datastore: "/dc2/datastore/ds1", Network: "ci-segment-152"},
+			},
+		},
+	}, users)
+}
+
+func Test_getCIUsersFromMetadata_Installer(t *testing.T) {
+	// The installer writes vCenter and username, and failure domains may
+	// leave out the server when there is only one vCenter
+	users, err := getCIUsersFromMetadata([]byte(`{
+		"vsphere": {
+			"VCenters": [{"vCenter": "vc1.example.com", "username": "ci_user_01@vsphere.local"}],
+			"failureDomains": [{"name": "generated-failure-domain", "topology": {"datacenter": "dc1"}}]
+		}
+	}`))
+	assert.Nil(t, err)
+	assert.Equal(t, []*CIUser{{
+		Username:       "ci_user_01@vsphere.local",
+		VCenter:        "vc1.example.com",
+		FailureDomains: []FailureDomain{{Name: "generated-failure-domain", Datacenter: "dc1"}},
+	}}, users)
+}
+
+func Test_getCIUsersFromMetadata_Bad(t *testing.T) {
+	tests := []string{
+		`not json`,
+		`{"vsphere":{"vCenter":"vc1.example.com"}}`,
+		`{"vsphere":{"vcenters":[{"server":"vc1.example.com"}]}}`,
+	}
+
+	for _, test := range tests {
+		users, err := getCIUsersFromMetadata([]byte(test))
+		assert.True(t, errors.Is(err, ErrUserNotParsed), test)
+		assert.Nil(t, users)
+	}
+}
+
+func Test_Resolver_getCIUsersForTarget_MultiVCenter(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "e2e-vsphere", Namespace: "ci-op-9nmljnxm"},
+		Data: map[string][]byte{
+			"metadata.json": []byte(`{"vsphere":{"vcenters":[
+				{"server":"vc1.example.com","user":"ci_user_01@vsphere.local"},
+				{"server":"vc2.example.com","user":"ci_user_02@vsphere.local"}
+			]}}`),
+		},
+	})
+
+	r := NewResolver(clientset, ResolverConfig{VCenters: []string{"vc2.example.com"}})
+	users, err := r.getCIUsersForTarget("1234", "e2e-vsphere", "ci-op-9nmljnxm")
+	assert.Nil(t, err)
+	assert.Equal(t, []*CIUser{{
+		Username:  "ci_user_02@vsphere.local",
+		VCenter:   "vc2.example.com",
+		Namespace: "ci-op-9nmljnxm",
+		Target:    "e2e-vsphere",
+	}}, users)
+
+	r = NewResolver(clientset, ResolverConfig{VCenters: []string{"vc3.example.com"}})
+	_, err = r.getCIUsersForTarget("1234", "e2e-vsphere", "ci-op-9nmljnxm")
+	var unmonitored *UnmonitoredVCenterError
+	assert.True(t, errors.As(err, &unmonitored))
+	assert.Equal(t, "vc1.example.com", unmonitored.VCenter)
+}
+
+func Test_UnmonitoredVCenterError(t *testing.T) {
+	err := errors.Wrap(errors.WithStack(&UnmonitoredVCenterError{VCenter: "vc2.example.com"}), "build-id 1234")
+
+	var unmonitored *UnmonitoredVCenterError
+	assert.True(t, errors.As(err, &unmonitored))
+	assert.Equal(t, "vc2.example.com", unmonitored.VCenter)
+}
+
+func Test_getPodIPs(t *testing.T) {
+	pods := []corev1.Pod{
+		{Status: corev1.PodStatus{PodIP: "10.0.0.1", PodIPs: []corev1.PodIP{{IP: "10.0.0.1"}, {IP: "fd00::1"}}}},
+		{Status: corev1.PodStatus{PodIP: "10.0.0.2"}},
+		{Spec: corev1.PodSpec{HostNetwork: true}, Status: corev1.PodStatus{PodIP: "192.168.0.1"}},
+		{},
+	}
+	assert.Equal(t, []string{"10.0.0.1", "fd00::1", "10.0.0.2"}, getPodIPs(pods))
+}
+
+func Test_Resolver_getCiNamespace_Labels(t *testing.T) {
+	labels := map[string]string{CreatedByCILabel: "true", DefaultBuildIDLabel: "1234"}
+	clientset := fake.NewSimpleClientset(
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "release-images", Namespace: "ci-release", Labels: labels}},
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "e2e-vsphere", Namespace: "ci-op-9nmljnxm", Labels: labels}},
+	)
+
+	var strategies []string
+	r := NewResolver(clientset, ResolverConfig{})
+	r.OnNamespaceFound = func(strategy string) {
+		strategies = append(strategies, strategy)
+	}
+
+	ns, err := r.getCiNamespace("1234")
+	assert.Nil(t, err)
+	assert.Equal(t, "ci-op-9nmljnxm", ns)
+	assert.Equal(t, []string{NamespaceStrategyLabels}, strategies)
+}
+
+func Test_Resolver_getCiNamespace_NotFound(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Name:      "e2e-vsphere",
+			Namespace: "ci-op-9nmljnxm",
+			Labels:    map[string]string{CreatedByCILabel: "true", "ci.openshift.io/build-id": "1234"},
+		}},
+	)
+
+	// The build ID is in a different label than configured, and there is no
+	// job pod to read the logs of
+	r := NewResolver(clientset, ResolverConfig{})
+	_, err := r.getCiNamespace("1234")
+	assert.True(t, errors.Is(err, ErrJobPodNotFound))
+
+	r = NewResolver(clientset, ResolverConfig{BuildIDLabel: "ci.openshift.io/build-id"})
+	ns, err := r.getCiNamespace("1234")
+	assert.Nil(t, err)
+	assert.Equal(t, "ci-op-9nmljnxm", ns)
+}
+
+func Test_Resolver_getCiNamespaceFromLogs(t *testing.T) {
+	jobPod := func(name string, phase corev1.PodPhase) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: "ci",
+				Labels:    map[string]string{"prow.k8s.io/build-id": "1234"},
+			},
+			Status: corev1.PodStatus{Phase: phase},
+		}
+	}
+
+	r := NewResolver(fake.NewSimpleClientset(), ResolverConfig{})
+	_, err := r.getCiNamespaceFromLogs("1234")
+	assert.True(t, errors.Is(err, ErrJobPodNotFound))
+
+	// The fake clientset's logs never have the namespace, every pod is tried
+	r = NewResolver(fake.NewSimpleClientset(jobPod("a", corev1.PodFailed), jobPod("b", corev1.PodRunning)), ResolverConfig{})
+	_, err = r.getCiNamespaceFromLogs("1234")
+	assert.True(t, errors.Is(err, ErrNamespaceNotInLogs))
+}
+
+func Test_orderJobPods(t *testing.T) {
+	now := time.Now()
+	pod := func(name string, phase corev1.PodPhase, age time.Duration) corev1.Pod {
+		return corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, CreationTimestamp: metav1.NewTime(now.Add(-age))},
+			Status:     corev1.PodStatus{Phase: phase},
+		}
+	}
+
+	ordered := orderJobPods([]corev1.Pod{
+		pod("failed-old", corev1.PodFailed, 3*time.Hour),
+		pod("running-old", corev1.PodRunning, 2*time.Hour),
+		pod("pending-new", corev1.PodPending, time.Minute),
+		pod("running-new", corev1.PodRunning, time.Hour),
+	})
+
+	var names []string
+	for _, p := range ordered {
+		names = append(names, p.Name)
+	}
+	assert.Equal(t, []string{"running-new", "running-old", "pending-new", "failed-old"}, names)
+}
+
+func Test_PodLogsError(t *testing.T) {
+	cause := errors.New("container \"test\" in pod \"1234\" is waiting to start")
+	var err error = &PodLogsError{Pod: "ci/1234", Err: cause}
+
+	var podLogs *PodLogsError
+	assert.True(t, errors.As(err, &podLogs))
+	assert.Equal(t, "ci/1234", podLogs.Pod)
+	assert.True(t, errors.Is(err, cause))
+	assert.Equal(t, `unable to read logs of pod ci/1234: container "test" in pod "1234" is waiting to start`, err.Error())
+}
+
+func Test_getCiNamespaceFromPodLogs_StopsAtMatch(t *testing.T) {
+	// Nothing past the matching line is read
+	logs := io.MultiReader(strings.NewReader(GoodLog), iotest.ErrReader(errors.New("read too far")))
+	result, err := getCiNamespaceFromPodLogs(logs, UsingNamespaceRegex)
+	assert.Nil(t, err)
+	assert.Equal(t, "ci-op-9nmljnxm", result)
+}
+
+func Test_getCiNamespaceFromPodLogs_Regex(t *testing.T) {
+	regex, err := ParseNamespaceRegex(`Created namespace (ci-op-[a-z0-9]+)`)
+	assert.Nil(t, err)
+
+	result, err := getCiNamespaceFromPodLogs(strings.NewReader("INFO Starting\nINFO Created namespace ci-op-abcd1234\n"), regex)
+	assert.Nil(t, err)
+	assert.Equal(t, "ci-op-abcd1234", result)
+
+	_, err = getCiNamespaceFromPodLogs(strings.NewReader(GoodLog), regexp.MustCompile(`Created namespace (ci-op-[a-z0-9]+)`))
+	assert.True(t, errors.Is(err, ErrNamespaceNotInLogs))
+}
+
+func Test_ParseNamespaceRegex_Bad(t *testing.T) {
+	_, err := ParseNamespaceRegex(`Using namespace ci-op-.*`)
+	assert.NotNil(t, err)
+
+	_, err = ParseNamespaceRegex(`(`)
+	assert.NotNil(t, err)
+}
+
+func Test_resolutionCache(t *testing.T) {
+	c := newResolutionCache(time.Hour, time.Minute)
+	now := time.Date(2022, 1, 1, 12, 0, 0, 0, time.UTC)
+	c.now = func() time.Time { return now }
+
+	c.put("1", []*CIUser{{Username: "ci_user_01@vsphere.local"}}, nil)
+	c.put("2", nil, ErrSecretMissing)
+	c.put("3", nil, &UnmonitoredVCenterError{VCenter: "vc3.example.com"})
+
+	entry, ok := c.get("1")
+	assert.True(t, ok)
+	assert.Equal(t, "ci_user_01@vsphere.local", entry.users[0].Username)
+	entry.users[0].Username = "changed"
+	entry, _ = c.get("1")
+	assert.Equal(t, "ci_user_01@vsphere.local", entry.users[0].Username)
+
+	entry, ok = c.get("2")
+	assert.True(t, ok)
+	assert.Equal(t, ErrSecretMissing, entry.err)
+
+	// Failures expire sooner, except for unmonitored vCenters
+	now = now.Add(2 * time.Minute)
+	_, ok = c.get("2")
+	assert.False(t, ok)
+	_, ok = c.get("3")
+	assert.True(t, ok)
+
+	c.retain(map[string]bool{"3": true})
+	_, ok = c.get("1")
+	assert.False(t, ok)
+	assert.Equal(t, 1, c.len())
+}
+
+func Test_Resolver_GetCIUsersForBuildID_Cache(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Name:      "e2e-vsphere",
+			Namespace: "ci-op-9nmljnxm",
+			Labels:    map[string]string{CreatedByCILabel: "true", DefaultBuildIDLabel: "1234"},
+		}},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "e2e-vsphere", Namespace: "ci-op-9nmljnxm"},
+			Data: map[string][]byte{
+				"metadata.json": []byte(`{"vsphere":{"vCenter":"vc1.example.com","username":"ci_user_01@vsphere.local"}}`),
+			},
+		},
+	)
+
+	lookups := map[string]int{}
+	r := NewResolver(clientset, ResolverConfig{
+		VCenters:         []string{"vc1.example.com"},
+		CacheTTL:         time.Hour,
+		NegativeCacheTTL: time.Minute,
+	})
+	r.OnCacheLookup = func(result string) {
+		lookups[result]++
+	}
+
+	users, err := r.GetCIUsersForBuildID("1234", []string{"e2e-vsphere"})
+	assert.Nil(t, err)
+	assert.Equal(t, []*CIUser{{Username: "ci_user_01@vsphere.local", VCenter: "vc1.example.com", Namespace: "ci-op-9nmljnxm", Target: "e2e-vsphere"}}, users)
+
+	// Served from the cache, even though the build cluster changed
+	assert.Nil(t, clientset.CoreV1().Secrets("ci-op-9nmljnxm").Delete(context.TODO(), "e2e-vsphere", metav1.DeleteOptions{}))
+	cached, err := r.GetCIUsersForBuildID("1234", []string{"e2e-vsphere"})
+	assert.Nil(t, err)
+	assert.Equal(t, users, cached)
+	assert.Equal(t, map[string]int{CacheMiss: 1, CacheHit: 1}, lookups)
+
+	// The job stopped running
+	r.Forget(map[string]bool{})
+	_, err = r.GetCIUsersForBuildID("1234", []string{"e2e-vsphere"})
+	assert.True(t, errors.Is(err, ErrSecretMissing))
+	_, err = r.GetCIUsersForBuildID("1234", []string{"e2e-vsphere"})
+	assert.True(t, errors.Is(err, ErrSecretMissing))
+	assert.Equal(t, map[string]int{CacheMiss: 2, CacheHit: 1, CacheNegativeHit: 1}, lookups)
+}
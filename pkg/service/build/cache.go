@@ -0,0 +1,111 @@
+package build
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Results of a lookup in the resolution cache
+const (
+	CacheHit         = "hit"
+	CacheNegativeHit = "negative_hit" // A cached failure
+	CacheMiss        = "miss"
+)
+
+// resolutionCache remembers the CI users of jobs by build ID, since they never
+// change while a job runs. Failures are remembered too, for less time, so jobs
+// that can't be resolved don't cost a round of API calls on every refresh.
+type resolutionCache struct {
+	ttl         time.Duration
+	negativeTTL time.Duration
+	now         func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+}
+
+type cacheEntry struct {
+	users   []*CIUser
+	err     error
+	expires time.Time
+}
+
+func newResolutionCache(ttl, negativeTTL time.Duration) *resolutionCache {
+	return &resolutionCache{
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		now:         time.Now,
+		entries:     map[string]*cacheEntry{},
+	}
+}
+
+// get returns the cached result for buildID, if there is one.
+func (c *resolutionCache) get(buildID string) (cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[buildID]
+	if !ok || c.now().After(entry.expires) {
+		delete(c.entries, buildID)
+		return cacheEntry{}, false
+	}
+	return cacheEntry{
+		users:   copyUsers(entry.users),
+		err:     entry.err,
+		expires: entry.expires,
+	}, true
+}
+
+// put caches the result of resolving buildID. A job using a vCenter that isn't
+// monitored won't start using another one, so that is kept as long as a
+// success.
+func (c *resolutionCache) put(buildID string, users []*CIUser, err error) {
+	ttl := c.ttl
+	var unmonitored *UnmonitoredVCenterError
+	if err != nil && !errors.As(err, &unmonitored) {
+		ttl = c.negativeTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[buildID] = &cacheEntry{
+		users:   copyUsers(users),
+		err:     err,
+		expires: c.now().Add(ttl),
+	}
+}
+
+// retain evicts every build ID that isn't in buildIDs.
+func (c *resolutionCache) retain(buildIDs map[string]bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for buildID := range c.entries {
+		if !buildIDs[buildID] {
+			delete(c.entries, buildID)
+		}
+	}
+}
+
+func (c *resolutionCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// copyUsers keeps callers from changing cached users.
+func copyUsers(users []*CIUser) []*CIUser {
+	if users == nil {
+		return nil
+	}
+	copied := make([]*CIUser, 0, len(users))
+	for _, u := range users {
+		user := *u
+		copied = append(copied, &user)
+	}
+	return copied
+}
@@ -0,0 +1,91 @@
+package kube
+
+import (
+	"net/http"
+
+	"github.com/pkg/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/transport"
+)
+
+// AuthConfig says how to reach and authenticate to a Kubernetes API server.
+// Either Kubeconfig or InCluster must be set.
+type AuthConfig struct {
+	Kubeconfig string // Path to a kubeconfig file
+	Context    string // Kubeconfig context, defaults to the current context
+	InCluster  bool   // Use the service account of the pod the exporter runs in
+
+	// Bearer token file used instead of the credentials in the kubeconfig.
+	// client-go re-reads it every minute, so rotated tokens are picked up.
+	TokenFile string
+}
+
+// Configured reports whether an API server has been given at all.
+func (a AuthConfig) Configured() bool {
+	return a.Kubeconfig != "" || a.InCluster
+}
+
+// RESTConfig builds the client config for an AuthConfig.
+func RESTConfig(auth AuthConfig) (*rest.Config, error) {
+	var config *rest.Config
+	var err error
+	switch {
+	case auth.InCluster && auth.Kubeconfig != "":
+		return nil, errors.New("in-cluster config and a kubeconfig can't be used together")
+	case auth.InCluster && auth.Context != "":
+		return nil, errors.New("a kubeconfig context can't be used with in-cluster config")
+	case auth.InCluster:
+		config, err = rest.InClusterConfig()
+	case auth.Kubeconfig != "":
+		config, err = clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+			&clientcmd.ClientConfigLoadingRules{ExplicitPath: auth.Kubeconfig},
+			&clientcmd.ConfigOverrides{CurrentContext: auth.Context},
+		).ClientConfig()
+	default:
+		return nil, errors.New("no kubeconfig given and not running in-cluster")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if auth.TokenFile != "" {
+		config.BearerToken = ""
+		config.BearerTokenFile = auth.TokenFile
+		config.Username = ""
+		config.Password = ""
+		config.AuthProvider = nil
+		config.ExecProvider = nil
+	}
+
+	return config, nil
+}
+
+// OnUnauthorized makes clients built from config call fn every time the API
+// server rejects their credentials, e.g. because a token expired or was
+// revoked.
+func OnUnauthorized(config *rest.Config, fn func()) {
+	config.WrapTransport = transport.Wrappers(config.WrapTransport, func(rt http.RoundTripper) http.RoundTripper {
+		return &unauthorizedRoundTripper{rt: rt, fn: fn}
+	})
+}
+
+type unauthorizedRoundTripper struct {
+	rt http.RoundTripper
+	fn func()
+}
+
+func (u *unauthorizedRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := u.rt.RoundTrip(req)
+	if err == nil && resp.StatusCode == http.StatusUnauthorized {
+		u.fn()
+	}
+	return resp, err
+}
+
+// IsUnauthorized reports whether err is the API server rejecting our
+// credentials.
+func IsUnauthorized(err error) bool {
+	return apierrors.IsUnauthorized(err)
+}
@@ -0,0 +1,142 @@
+package kube
+
+import (
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"k8s.io/client-go/kubernetes"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+const testKubeconfig = `apiVersion: v1
+kind: Config
+clusters:
+- name: build01
+  cluster:
+    server: https://api.build01.example.com:6443
+- name: vsphere
+  cluster:
+    server: https://api.vsphere.example.com:6443
+users:
+- name: exporter
+  user:
+    token: s3cret
+contexts:
+- name: build01
+  context:
+    cluster: build01
+    user: exporter
+- name: vsphere
+  context:
+    cluster: vsphere
+    user: exporter
+current-context: build01
+`
+
+func writeTestFile(t *testing.T, name, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	err := ioutil.WriteFile(path, []byte(content), 0600)
+	assert.Nil(t, err)
+	return path
+}
+
+func Test_RESTConfig_Context(t *testing.T) {
+	kubeconfig := writeTestFile(t, "kubeconfig", testKubeconfig)
+
+	config, err := RESTConfig(AuthConfig{Kubeconfig: kubeconfig})
+	assert.Nil(t, err)
+	assert.Equal(t, "https://api.build01.example.com:6443", config.Host)
+	assert.Equal(t, "s3cret", config.BearerToken)
+
+	config, err = RESTConfig(AuthConfig{Kubeconfig: kubeconfig, Context: "vsphere"})
+	assert.Nil(t, err)
+	assert.Equal(t, "https://api.vsphere.example.com:6443", config.Host)
+
+	_, err = RESTConfig(AuthConfig{Kubeconfig: kubeconfig, Context: "build05"})
+	assert.NotNil(t, err)
+}
+
+func Test_RESTConfig_TokenFile(t *testing.T) {
+	kubeconfig := writeTestFile(t, "kubeconfig", testKubeconfig)
+	tokenFile := writeTestFile(t, "token", "t0ken")
+
+	config, err := RESTConfig(AuthConfig{Kubeconfig: kubeconfig, TokenFile: tokenFile})
+	assert.Nil(t, err)
+	assert.Equal(t, "https://api.build01.example.com:6443", config.Host)
+	assert.Equal(t, "", config.BearerToken)
+	assert.Equal(t, tokenFile, config.BearerTokenFile)
+}
+
+func Test_RESTConfig_Bad(t *testing.T) {
+	kubeconfig := writeTestFile(t, "kubeconfig", testKubeconfig)
+
+	tests := []AuthConfig{
+		{},
+		{TokenFile: "/var/run/secrets/token"},
+		{Kubeconfig: kubeconfig, InCluster: true},
+		{InCluster: true, Context: "vsphere"},
+		{Kubeconfig: filepath.Join(t.TempDir(), "missing")},
+	}
+
+	for _, test := range tests {
+		_, err := RESTConfig(test)
+		assert.NotNil(t, err, "%+v", test)
+	}
+}
+
+func Test_OnUnauthorized(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer t0ken" {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"kind":"Status","apiVersion":"v1","status":"Failure","message":"Unauthorized","reason":"Unauthorized","code":401}`))
+			return
+		}
+		w.Write([]byte(`{"major":"1","minor":"22"}`))
+	}))
+	defer server.Close()
+
+	kubeconfig := writeTestFile(t, "kubeconfig", `apiVersion: v1
+kind: Config
+clusters:
+- name: test
+  cluster:
+    server: `+server.URL+`
+users:
+- name: exporter
+  user:
+    token: expired
+contexts:
+- name: test
+  context:
+    cluster: test
+    user: exporter
+current-context: test
+`)
+	tokenFile := writeTestFile(t, "token", "t0ken")
+
+	unauthorized := 0
+	config, err := RESTConfig(AuthConfig{Kubeconfig: kubeconfig})
+	assert.Nil(t, err)
+	OnUnauthorized(config, func() { unauthorized++ })
+	clientset, err := kubernetes.NewForConfig(config)
+	assert.Nil(t, err)
+
+	_, err = clientset.Discovery().ServerVersion()
+	assert.True(t, IsUnauthorized(errors.Wrap(err, "build cluster vsphere")))
+	assert.Equal(t, 1, unauthorized)
+
+	config, err = RESTConfig(AuthConfig{Kubeconfig: kubeconfig, TokenFile: tokenFile})
+	assert.Nil(t, err)
+	OnUnauthorized(config, func() { unauthorized++ })
+	clientset, err = kubernetes.NewForConfig(config)
+	assert.Nil(t, err)
+
+	_, err = clientset.Discovery().ServerVersion()
+	assert.Nil(t, err)
+	assert.False(t, IsUnauthorized(err))
+	assert.Equal(t, 1, unauthorized)
+}
@@ -0,0 +1,88 @@
+package prow
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/pkg/errors"
+	prowapiv1 "k8s.io/test-infra/prow/apis/prowjobs/v1"
+)
+
+// decodeProwJobs walks the items of a ProwJobList one job at a time, keeping
+// only the jobs keep returns true for. Unlike unmarshalling the whole list,
+// only a single job is held in memory at once.
+func decodeProwJobs(r io.Reader, keep func(job *prowapiv1.ProwJob) bool) ([]prowapiv1.ProwJob, error) {
+	dec := json.NewDecoder(r)
+
+	err := expectDelim(dec, '{')
+	if err != nil {
+		return nil, err
+	}
+
+	var jobs []prowapiv1.ProwJob
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+
+		if key, _ := t.(string); key != "items" {
+			// Skip values we don't care about, like kind and metadata
+			var skip json.RawMessage
+			err = dec.Decode(&skip)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		err = expectDelim(dec, '[')
+		if err != nil {
+			return nil, err
+		}
+
+		// Index of the item, not of the kept job, so errors point at the
+		// right place in the payload
+		for i := 0; dec.More(); i++ {
+			var job prowapiv1.ProwJob
+			err = dec.Decode(&job)
+			if err != nil {
+				return nil, errors.Wrapf(err, "error decoding prow job %d", i)
+			}
+			if keep(&job) {
+				jobs = append(jobs, job)
+			}
+		}
+
+		err = expectDelim(dec, ']')
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return jobs, expectDelim(dec, '}')
+}
+
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	t, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if d, ok := t.(json.Delim); !ok || d != delim {
+		return fmt.Errorf("expected %s in prow JSON but found %v", delim, t)
+	}
+	return nil
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,94 @@
+package prow
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	prowapiv1 "k8s.io/test-infra/prow/apis/prowjobs/v1"
+)
+
+const (
+	// Retries of a failed request to Prow, after the first attempt
+	defaultRetries = 3
+
+	// Delay before the first retry. It doubles on every retry, up to
+	// maxRetryDelay.
+	defaultRetryDelay = time.Second
+	maxRetryDelay     = 30 * time.Second
+)
+
+// fetchCache is what's needed to ask Prow for prowjobs.js only if it changed
+// since it was last decoded.
+type fetchCache struct {
+	etag         string
+	lastModified string
+	jobs         []prowapiv1.ProwJob // Selected jobs of the last payload
+}
+
+// do sends req, retrying with exponential backoff and jitter when Prow can't
+// be reached or answers with a server error. Every response is counted by
+// status code. The returned response is never a server error. Retries stop
+// as soon as the context of req is done.
+func (a *AnonymousDataProvider) do(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	delay := a.retryDelay
+	for attempt := 0; ; attempt++ {
+		resp, err := a.client.Do(req)
+		if err != nil {
+			a.requests.WithLabelValues("error").Inc()
+			if ctx.Err() != nil {
+				return nil, err
+			}
+		} else {
+			a.requests.WithLabelValues(strconv.Itoa(resp.StatusCode)).Inc()
+			if !retryable(resp.StatusCode) {
+				return resp, nil
+			}
+			// Drain the body so the connection can be reused
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+			err = errors.Errorf("unexpected status from prow (%d)", resp.StatusCode)
+		}
+
+		if attempt >= a.retries {
+			return nil, errors.Wrapf(err, "giving up after %d attempts", attempt+1)
+		}
+
+		// Equal jitter keeps exporters that failed together from retrying
+		// together, while still waiting at least half the delay
+		sleep := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		log.Debugf("retrying prow request in %s: %s", sleep, err)
+		if err := a.sleep(ctx, sleep); err != nil {
+			return nil, errors.Wrapf(err, "gave up retrying after %d attempts", attempt+1)
+		}
+
+		delay *= 2
+		if delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
+
+// sleepContext waits for d, or until ctx is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func retryable(statusCode int) bool {
+	return statusCode >= 500 || statusCode == http.StatusTooManyRequests
+}
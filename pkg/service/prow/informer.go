@@ -0,0 +1,193 @@
+package prow
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/cache"
+	prowapiv1 "k8s.io/test-infra/prow/apis/prowjobs/v1"
+	prowclient "k8s.io/test-infra/prow/client/clientset/versioned"
+	prowinformers "k8s.io/test-infra/prow/client/informers/externalversions"
+	prowlisters "k8s.io/test-infra/prow/client/listers/prowjobs/v1"
+)
+
+// InformerDataProvider serves vSphere ProwJobs from a local cache that is kept
+// up to date by watching the Prow cluster. Until the cache has synced, or
+// while the watch is broken, it falls back to listing ProwJobs directly.
+type InformerDataProvider struct {
+	informer cache.SharedIndexInformer
+	lister   prowlisters.ProwJobLister
+	fallback *AuthenticatedDataProvider
+	selector *Selector
+	stop     chan struct{}
+
+	mu          sync.Mutex
+	watchBroken bool
+	brokenAtRV  string // Resource version the watch broke at
+
+	cacheSynced prometheus.Gauge
+	resynced    prometheus.Counter
+	watchErrors prometheus.Counter
+	fallbacks   prometheus.Counter
+	transitions *prometheus.CounterVec
+}
+
+// NewInformerDataProvider starts watching the ProwJobs matching selector's
+// label selector. The cache is resynced every resync. Stop must be called to
+// stop watching.
+func NewInformerDataProvider(client prowclient.Interface, resync time.Duration, selector *Selector) (*InformerDataProvider, error) {
+	fallback, err := NewAuthenticatedDataProvier(client, selector)
+	if err != nil {
+		return nil, err
+	}
+
+	factory := prowinformers.NewSharedInformerFactoryWithOptions(client, resync,
+		prowinformers.WithNamespace(ProwJobNamespace),
+		prowinformers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.LabelSelector = selector.LabelSelector()
+		}))
+	jobInformer := factory.Prow().V1().ProwJobs()
+
+	i := &InformerDataProvider{
+		informer: jobInformer.Informer(),
+		lister:   jobInformer.Lister(),
+		fallback: fallback,
+		selector: selector,
+		stop:     make(chan struct{}),
+		cacheSynced: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "prow_cache_synced",
+			Help:      "Is the ProwJob cache synced and watching.",
+		}),
+		resynced: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "prow_cache_resynced_jobs_total",
+			Help:      "ProwJobs seen again by a periodic resync of the cache.",
+		}),
+		watchErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "prow_cache_watch_errors_total",
+			Help:      "Times the ProwJob watch broke.",
+		}),
+		fallbacks: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "prow_cache_fallbacks_total",
+			Help:      "Times ProwJobs were listed directly because the cache wasn't usable.",
+		}),
+		transitions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "prow_job_transitions_total",
+			Help:      "State transitions of vSphere ProwJobs seen by the watch, by new state.",
+		}, []string{"state"}),
+	}
+
+	err = i.informer.SetWatchErrorHandler(func(r *cache.Reflector, err error) {
+		i.mu.Lock()
+		i.watchBroken = true
+		i.brokenAtRV = i.informer.LastSyncResourceVersion()
+		i.mu.Unlock()
+
+		i.watchErrors.Inc()
+		cache.DefaultWatchErrorHandler(r, err)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	i.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: i.onUpdate,
+	})
+
+	factory.Start(i.stop)
+	return i, nil
+}
+
+func (i *InformerDataProvider) onUpdate(oldObj, newObj interface{}) {
+	oldJob, ok := oldObj.(*prowapiv1.ProwJob)
+	if !ok {
+		return
+	}
+	newJob, ok := newObj.(*prowapiv1.ProwJob)
+	if !ok {
+		return
+	}
+
+	if oldJob.ResourceVersion == newJob.ResourceVersion {
+		// Nothing changed, this is the periodic resync
+		i.resynced.Inc()
+		return
+	}
+
+	if oldJob.Status.State != newJob.Status.State {
+		log.Debugf("prow job %s went from %s to %s", newJob.Name, oldJob.Status.State, newJob.Status.State)
+		i.transitions.WithLabelValues(string(newJob.Status.State)).Inc()
+	}
+}
+
+// usable reports whether the cache can be trusted. A broken watch counts as
+// recovered once the informer has synced past where it broke.
+func (i *InformerDataProvider) usable() bool {
+	if !i.informer.HasSynced() {
+		return false
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.watchBroken && i.informer.LastSyncResourceVersion() != i.brokenAtRV {
+		log.Info("prow job watch recovered")
+		i.watchBroken = false
+	}
+	return !i.watchBroken
+}
+
+func (i *InformerDataProvider) GetData(ctx context.Context) ([]prowapiv1.ProwJob, error) {
+	if !i.usable() {
+		i.cacheSynced.Set(0)
+		i.fallbacks.Inc()
+		log.Debug("prow job cache not usable, listing prow jobs directly")
+		return i.fallback.GetData(ctx)
+	}
+	i.cacheSynced.Set(1)
+
+	jobs, err := i.lister.ProwJobs(ProwJobNamespace).List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+
+	var vsphereProwJobs []prowapiv1.ProwJob
+	for _, job := range jobs {
+		if i.selector.Matches(job) {
+			// The cache is shared, so copy
+			vsphereProwJobs = append(vsphereProwJobs, *job.DeepCopy())
+		}
+	}
+
+	log.Debugf("Found %d relevant Prow jobs in cache", len(vsphereProwJobs))
+	return vsphereProwJobs, nil
+}
+
+// Stop stops watching ProwJobs.
+func (i *InformerDataProvider) Stop() {
+	close(i.stop)
+}
+
+func (i *InformerDataProvider) Describe(ch chan<- *prometheus.Desc) {
+	ch <- i.cacheSynced.Desc()
+	ch <- i.resynced.Desc()
+	ch <- i.watchErrors.Desc()
+	ch <- i.fallbacks.Desc()
+	i.transitions.Describe(ch)
+}
+
+func (i *InformerDataProvider) Collect(ch chan<- prometheus.Metric) {
+	ch <- i.cacheSynced
+	ch <- i.resynced
+	ch <- i.watchErrors
+	ch <- i.fallbacks
+	i.transitions.Collect(ch)
+}
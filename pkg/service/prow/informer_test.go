@@ -0,0 +1,101 @@
+package prow
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	k8stesting "k8s.io/client-go/testing"
+	prowapiv1 "k8s.io/test-infra/prow/apis/prowjobs/v1"
+	"k8s.io/test-infra/prow/client/clientset/versioned/fake"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestJob(resourceVersion string, state prowapiv1.ProwJobState) *prowapiv1.ProwJob {
+	return &prowapiv1.ProwJob{
+		ObjectMeta: metav1.ObjectMeta{Name: "job", ResourceVersion: resourceVersion},
+		Status:     prowapiv1.ProwJobStatus{State: state},
+	}
+}
+
+func Test_InformerDataProvider_onUpdate(t *testing.T) {
+	i := &InformerDataProvider{
+		resynced:    prometheus.NewCounter(prometheus.CounterOpts{Name: "resynced"}),
+		transitions: prometheus.NewCounterVec(prometheus.CounterOpts{Name: "transitions"}, []string{"state"}),
+	}
+
+	// Periodic resync
+	i.onUpdate(newTestJob("1", prowapiv1.PendingState), newTestJob("1", prowapiv1.PendingState))
+	assert.Equal(t, float64(1), testutil.ToFloat64(i.resynced))
+
+	// Status update without a state change
+	i.onUpdate(newTestJob("1", prowapiv1.PendingState), newTestJob("2", prowapiv1.PendingState))
+	assert.Equal(t, 0, testutil.CollectAndCount(i.transitions))
+
+	// Job finished
+	i.onUpdate(newTestJob("2", prowapiv1.PendingState), newTestJob("3", prowapiv1.SuccessState))
+	assert.Equal(t, float64(1), testutil.ToFloat64(i.transitions.WithLabelValues("success")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(i.resynced))
+}
+
+func Test_InformerDataProvider_GetData_Fallback(t *testing.T) {
+	job := newSelectorTestJob("e2e", VSphereClusterAlias, prowapiv1.PendingState, prowapiv1.PresubmitJob)
+	job.Name = "job"
+	job.Namespace = ProwJobNamespace
+	client := fake.NewSimpleClientset()
+
+	// Every list is a newer resource version, and the watch fails until told
+	// otherwise
+	var mu sync.Mutex
+	lists := 0
+	watchFails := true
+	client.PrependReactor("list", "prowjobs", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		lists++
+		return true, &prowapiv1.ProwJobList{
+			ListMeta: metav1.ListMeta{ResourceVersion: strconv.Itoa(lists)},
+			Items:    []prowapiv1.ProwJob{*job},
+		}, nil
+	})
+	client.PrependWatchReactor("prowjobs", func(action k8stesting.Action) (bool, watch.Interface, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if watchFails {
+			return true, nil, errors.New("watch failed")
+		}
+		return true, watch.NewFake(), nil
+	})
+
+	selector, err := NewSelector(DefaultSelectorConfig(true))
+	assert.Nil(t, err)
+	provider, err := NewInformerDataProvider(client, 0, selector)
+	assert.Nil(t, err)
+	defer provider.Stop()
+
+	// The watch broke, so ProwJobs are listed directly
+	assert.Eventually(t, func() bool { return testutil.ToFloat64(provider.watchErrors) > 0 }, 5*time.Second, 10*time.Millisecond)
+	jobs, err := provider.GetData(context.TODO())
+	assert.Nil(t, err)
+	assert.Len(t, jobs, 1)
+	assert.Equal(t, float64(1), testutil.ToFloat64(provider.fallbacks))
+	assert.Equal(t, float64(0), testutil.ToFloat64(provider.cacheSynced))
+
+	// Once the informer lists and watches again, the cache is used
+	mu.Lock()
+	watchFails = false
+	mu.Unlock()
+	assert.Eventually(t, func() bool {
+		jobs, err = provider.GetData(context.TODO())
+		return testutil.ToFloat64(provider.cacheSynced) == 1
+	}, 10*time.Second, 50*time.Millisecond)
+	assert.Nil(t, err)
+	assert.Len(t, jobs, 1)
+}
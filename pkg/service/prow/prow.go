@@ -1,96 +1,255 @@
 package prow
 
 import (
+	"compress/gzip"
 	"context"
-	"encoding/json"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
+	"io"
 	"io/ioutil"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/rest"
 	prowapiv1 "k8s.io/test-infra/prow/apis/prowjobs/v1"
 	prowclient "k8s.io/test-infra/prow/client/clientset/versioned"
 	"net/http"
-	"regexp"
+	"net/url"
+	"path"
+	"strings"
+	"time"
 )
 
 const (
 	VSphereClusterAlias = "vsphere"
+
+	// Where ProwJobs live on the Prow cluster, and how the vSphere ones are
+	// labeled
+	ProwJobNamespace     = "ci"
+	VSphereLabelSelector = "ci-operator.openshift.io/cloud=vsphere"
+
+	// Label ci-operator's job generator puts the variant of a job in
+	VariantLabel = "ci-operator.openshift.io/variant"
+
+	// Prefix of the metrics providers expose about themselves
+	namespace = "vsphere_ci_user_sessions"
 )
 
 var (
-	TargetRegex = regexp.MustCompile(`^--target=(.*)$`)
+	ErrTargetNotFound = errors.New("unable to find --target arg in prow job")
 )
 
 type DataProvider interface {
-	GetData() ([]prowapiv1.ProwJob, error)
+	GetData(ctx context.Context) ([]prowapiv1.ProwJob, error)
 }
 
+// AnonymousDataProvider lists Prow jobs from Deck's public prowjobs.js.
 type AnonymousDataProvider struct {
+	jobsURL  string
+	client   *http.Client
+	selector *Selector
+
+	// How failed requests are retried
+	retries    int
+	retryDelay time.Duration
+	sleep      func(context.Context, time.Duration) error
+
+	// Last prowjobs.js, for conditional requests. Only used by GetData.
+	cache fetchCache
+
+	// Size and decode time of the last prowjobs.js, and requests by status
+	payloadBytes  prometheus.Gauge
+	decodeSeconds prometheus.Gauge
+	requests      *prometheus.CounterVec
+}
+
+// NewAnonymousDataProvider creates a provider for the Prow instance at
+// baseURL. caFile optionally names a PEM bundle to trust in addition to the
+// system roots, and timeout limits each request. Only jobs matching selector
+// are returned.
+func NewAnonymousDataProvider(baseURL string, caFile string, timeout time.Duration, selector *Selector) (*AnonymousDataProvider, error) {
+	u, err := ParseBaseURL(baseURL)
+	if err != nil {
+		return nil, err
+	}
+
+	u.Path = path.Join(u.Path, "prowjobs.js")
+	u.RawQuery = "omit=decoration_config"
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if caFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "error reading prow CA file")
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in prow CA file %s", caFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	return &AnonymousDataProvider{
+		jobsURL:  u.String(),
+		selector: selector,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   timeout,
+		},
+		retries:    defaultRetries,
+		retryDelay: defaultRetryDelay,
+		sleep:      sleepContext,
+		payloadBytes: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "prow_payload_bytes",
+			Help:      "Size of the last prowjobs.js as transferred.",
+		}),
+		decodeSeconds: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "prow_decode_seconds",
+			Help:      "Time taken to decode the last prowjobs.js.",
+		}),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "prow_requests_total",
+			Help:      "Requests made to Prow, by HTTP status code (or error).",
+		}, []string{"code"}),
+	}, nil
+}
+
+// ParseBaseURL parses the base URL of a Prow instance. A bare hostname is
+// taken to mean https.
+func ParseBaseURL(baseURL string) (*url.URL, error) {
+	if !strings.Contains(baseURL, "://") {
+		baseURL = "https://" + baseURL
+	}
+
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "error parsing prow URL")
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme in prow URL: %s", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("no host in prow URL: %s", baseURL)
+	}
+
+	return u, nil
 }
 
-func (a AnonymousDataProvider) GetData() ([]prowapiv1.ProwJob, error) {
-	resp, err := http.Get("https://prow.ci.openshift.org/prowjobs.js?omit=decoration_config")
+func (a *AnonymousDataProvider) GetData(ctx context.Context) ([]prowapiv1.ProwJob, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, a.jobsURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	// Asking for gzip ourselves leaves decompression to us, so the payload
+	// size can be measured
+	req.Header.Set("Accept-Encoding", "gzip")
+	if a.cache.etag != "" {
+		req.Header.Set("If-None-Match", a.cache.etag)
+	}
+	if a.cache.lastModified != "" {
+		req.Header.Set("If-Modified-Since", a.cache.lastModified)
+	}
+
+	resp, err := a.do(req)
 	if err != nil {
 		return nil, errors.Wrap(err, "error retrieving list of prow jobs")
 	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		// Jobs can still age out of the selection
+		var vsphereProwJobs []prowapiv1.ProwJob
+		for i := range a.cache.jobs {
+			if a.selector.Matches(&a.cache.jobs[i]) {
+				vsphereProwJobs = append(vsphereProwJobs, *a.cache.jobs[i].DeepCopy())
+			}
+		}
+		log.Debugf("prowjobs.js not modified, found %d relevant Prow jobs", len(vsphereProwJobs))
+		return vsphereProwJobs, nil
+	}
 
 	if resp.StatusCode != http.StatusOK {
 		return nil, fmt.Errorf("unexpected status from prow (%d)", resp.StatusCode)
 	}
 
-	bytes, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, errors.Wrap(err, "error while reading prow response body")
+	// Count what actually came over the wire, before decompression
+	payload := &countingReader{r: resp.Body}
+	var body io.Reader = payload
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(payload)
+		if err != nil {
+			return nil, errors.Wrap(err, "error while reading gzipped prow response body")
+		}
+		defer gz.Close()
+		body = gz
 	}
 
-	var prowJobList prowapiv1.ProwJobList
-	err = json.Unmarshal(bytes, &prowJobList)
+	start := time.Now()
+	vsphereProwJobs, err := decodeProwJobs(body, a.selector.Matches)
 	if err != nil {
 		return nil, errors.Wrap(err, "error while parsing prow JSON response")
 	}
 
-	var vsphereProwJobs []prowapiv1.ProwJob
-	for _,job := range prowJobList.Items {
-		if job.ClusterAlias() == VSphereClusterAlias {
-			if job.Status.State == prowapiv1.PendingState{
-				// Only keep Pending vSphere Jobs
-				vsphereProwJobs = append(vsphereProwJobs, job)
-			}
-		}
+	a.decodeSeconds.Set(time.Since(start).Seconds())
+	a.payloadBytes.Set(float64(payload.n))
+
+	a.cache = fetchCache{
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+		jobs:         vsphereProwJobs,
 	}
 
 	log.Debugf("Found %d relevant Prow jobs", len(vsphereProwJobs))
 	return vsphereProwJobs, nil
 }
 
+func (a *AnonymousDataProvider) Describe(ch chan<- *prometheus.Desc) {
+	ch <- a.payloadBytes.Desc()
+	ch <- a.decodeSeconds.Desc()
+	a.requests.Describe(ch)
+}
+
+func (a *AnonymousDataProvider) Collect(ch chan<- prometheus.Metric) {
+	ch <- a.payloadBytes
+	ch <- a.decodeSeconds
+	a.requests.Collect(ch)
+}
+
 
 type AuthenticatedDataProvider struct {
-	clientset *prowclient.Clientset
+	clientset prowclient.Interface
+	selector  *Selector
 }
 
-func NewAuthenticatedDataProvier(client *prowclient.Clientset) (*AuthenticatedDataProvider, error) {
+func NewAuthenticatedDataProvier(client prowclient.Interface, selector *Selector) (*AuthenticatedDataProvider, error) {
 	return &AuthenticatedDataProvider{
 		clientset: client,
+		selector:  selector,
 	}, nil
 }
 
-func (b *AuthenticatedDataProvider) GetData() ([]prowapiv1.ProwJob, error) {
-	// Get list of vSphere ProwJobs
+func (b *AuthenticatedDataProvider) GetData(ctx context.Context) ([]prowapiv1.ProwJob, error) {
+	// Get list of vSphere ProwJobs, letting the server apply the label selector
 	log.Trace("Getting data from k8s")
-	jobList, err := b.clientset.ProwV1().ProwJobs("ci").List(context.TODO(), metav1.ListOptions{
-		LabelSelector: "ci-operator.openshift.io/cloud=vsphere",
+	jobList, err := b.clientset.ProwV1().ProwJobs(ProwJobNamespace).List(ctx, metav1.ListOptions{
+		LabelSelector: b.selector.LabelSelector(),
 	})
 	if err != nil {
 		return nil, err
 	}
 
 	var vsphereProwJobs []prowapiv1.ProwJob
-	for _,job := range jobList.Items {
-		if job.Status.State == prowapiv1.PendingState{
-			// Only keep Pending vSphere Jobs
-			vsphereProwJobs = append(vsphereProwJobs, job)
+	for i := range jobList.Items {
+		if b.selector.Matches(&jobList.Items[i]) {
+			vsphereProwJobs = append(vsphereProwJobs, jobList.Items[i])
 		}
 	}
 
@@ -98,12 +257,9 @@ func (b *AuthenticatedDataProvider) GetData() ([]prowapiv1.ProwJob, error) {
 	return vsphereProwJobs, nil
 }
 
-func BuildClient(kubeconfig string) (*prowclient.Clientset, error) {
-	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
-	if err != nil {
-		return nil, err
-	}
-
+// BuildClient creates a clientset for the cluster ProwJobs live in. See
+// kube.RESTConfig for building config.
+func BuildClient(config *rest.Config) (*prowclient.Clientset, error) {
 	clientset, err := prowclient.NewForConfig(config)
 	if err != nil {
 		return nil, err
@@ -112,24 +268,55 @@ func BuildClient(kubeconfig string) (*prowclient.Clientset, error) {
 	return clientset, nil
 }
 
-func GetTargetFromProwJob(job prowapiv1.ProwJob) (string, error) {
-	target := getTargetFromProwJobArgs(job.Spec.PodSpec.Containers[0].Args)
-	if target == "" {
-		return "", fmt.Errorf("unable to find --target arg in prow job")
+// GetTargetsFromProwJob returns every ci-operator target a job runs, in the
+// order they are given.
+func GetTargetsFromProwJob(job prowapiv1.ProwJob) ([]string, error) {
+	targets := getFlagValues(getProwJobArgs(job), "--target")
+	if len(targets) == 0 {
+		return nil, ErrTargetNotFound
+	}
+
+	return targets, nil
+}
+
+// getProwJobArgs returns the arguments of every container of a job. Jobs
+// that don't run on Kubernetes have none.
+func getProwJobArgs(job prowapiv1.ProwJob) []string {
+	if job.Spec.PodSpec == nil {
+		return nil
 	}
 
-	return target, nil
+	var args []string
+	for _, c := range job.Spec.PodSpec.Containers {
+		args = append(args, c.Args...)
+	}
+	return args
 }
 
-func getTargetFromProwJobArgs(args []string) string {
-	for _,s := range args {
-		matches := TargetRegex.FindStringSubmatch(s)
-		if matches == nil {
+// getFlagValues returns the values of every occurrence of flag in args, given
+// either as "--flag=value" or as "--flag value". Repeated values are only
+// returned once.
+func getFlagValues(args []string, flag string) []string {
+	var values []string
+	seen := map[string]bool{}
+	for i := 0; i < len(args); i++ {
+		var value string
+		switch {
+		case strings.HasPrefix(args[i], flag+"="):
+			value = strings.TrimPrefix(args[i], flag+"=")
+		case args[i] == flag && i+1 < len(args):
+			i++
+			value = args[i]
+		default:
 			continue
 		}
-		return matches[1]
+
+		if value != "" && !seen[value] {
+			seen[value] = true
+			values = append(values, value)
+		}
 	}
-	return ""
+	return values
 }
 
 func GetPRLinkFromJob(job prowapiv1.ProwJob) string {
@@ -146,3 +333,35 @@ func GetPRLinkFromJob(job prowapiv1.ProwJob) string {
 
 	return ""
 }
+
+// GetVariantFromProwJob returns the ci-operator variant of a job, or "" if it
+// has none.
+func GetVariantFromProwJob(job prowapiv1.ProwJob) string {
+	if variant := job.GetLabels()[VariantLabel]; variant != "" {
+		return variant
+	}
+	if variants := getFlagValues(getProwJobArgs(job), "--variant"); len(variants) > 0 {
+		return variants[0]
+	}
+	return ""
+}
+
+// GetRefsFromJob returns the repository a job is for. Periodics don't have
+// one, so the first of their extra repositories is used instead.
+func GetRefsFromJob(job prowapiv1.ProwJob) *prowapiv1.Refs {
+	if job.Spec.Refs != nil {
+		return job.Spec.Refs
+	}
+	if len(job.Spec.ExtraRefs) > 0 {
+		return &job.Spec.ExtraRefs[0]
+	}
+	return nil
+}
+
+// GetPullFromJob returns the first pull request a job tests, or nil.
+func GetPullFromJob(job prowapiv1.ProwJob) *prowapiv1.Pull {
+	if job.Spec.Refs == nil || len(job.Spec.Refs.Pulls) == 0 {
+		return nil
+	}
+	return &job.Spec.Refs.Pulls[0]
+}
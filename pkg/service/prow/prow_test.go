@@ -1,8 +1,19 @@
 package prow
 
 import (
+	"compress/gzip"
+	"context"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	prowapiv1 "k8s.io/test-infra/prow/apis/prowjobs/v1"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 )
 
 var (
@@ -23,12 +34,377 @@ var (
 	}
 )
 
-func Test_getTargetFromProwJobArgs_Good(t *testing.T) {
-	target := getTargetFromProwJobArgs(GoodArgs)
-	assert.Equal(t, "e2e-vsphere", target)
+func Test_getFlagValues_Good(t *testing.T) {
+	targets := getFlagValues(GoodArgs, "--target")
+	assert.Equal(t, []string{"e2e-vsphere"}, targets)
 }
 
-func Test_getTargetFromProwJobArgs_Bad(t *testing.T) {
-	target := getTargetFromProwJobArgs(BadArgs)
-	assert.Equal(t, "", target)
+func Test_getFlagValues_Bad(t *testing.T) {
+	targets := getFlagValues(BadArgs, "--target")
+	assert.Empty(t, targets)
+}
+
+func Test_getFlagValues(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		flag string
+		want []string
+	}{
+		{"equals", []string{"--target=e2e-vsphere"}, "--target", []string{"e2e-vsphere"}},
+		{"separate arg", []string{"--target", "e2e-vsphere"}, "--target", []string{"e2e-vsphere"}},
+		{"multiple", []string{"--target=e2e-vsphere", "--target", "e2e-vsphere-upi"}, "--target", []string{"e2e-vsphere", "e2e-vsphere-upi"}},
+		{"repeated", []string{"--target=e2e-vsphere", "--target=e2e-vsphere"}, "--target", []string{"e2e-vsphere"}},
+		{"missing value", []string{"--target"}, "--target", nil},
+		{"empty value", []string{"--target="}, "--target", nil},
+		{"prefix of another flag", []string{"--targets=e2e-vsphere", "--target-additional-suffix=x"}, "--target", nil},
+		{"variant", []string{"--target=e2e-vsphere", "--variant", "nightly-4.10"}, "--variant", []string{"nightly-4.10"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, getFlagValues(tt.args, tt.flag))
+		})
+	}
+}
+
+func Test_GetTargetsFromProwJob(t *testing.T) {
+	tests := []struct {
+		name    string
+		podSpec *corev1.PodSpec
+		want    []string
+		wantErr error
+	}{
+		{"no pod spec", nil, nil, ErrTargetNotFound},
+		{"no containers", &corev1.PodSpec{}, nil, ErrTargetNotFound},
+		{"no target", &corev1.PodSpec{Containers: []corev1.Container{{Args: BadArgs}}}, nil, ErrTargetNotFound},
+		{"single", &corev1.PodSpec{Containers: []corev1.Container{{Args: GoodArgs}}}, []string{"e2e-vsphere"}, nil},
+		{
+			"second container",
+			&corev1.PodSpec{Containers: []corev1.Container{{Args: BadArgs}, {Args: []string{"--target", "e2e-vsphere-upi"}}}},
+			[]string{"e2e-vsphere-upi"},
+			nil,
+		},
+		{
+			"several targets",
+			&corev1.PodSpec{Containers: []corev1.Container{{Args: []string{"--target=e2e-vsphere", "--target=e2e-vsphere-serial"}}}},
+			[]string{"e2e-vsphere", "e2e-vsphere-serial"},
+			nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			job := prowapiv1.ProwJob{Spec: prowapiv1.ProwJobSpec{PodSpec: tt.podSpec}}
+			targets, err := GetTargetsFromProwJob(job)
+			assert.Equal(t, tt.wantErr, err)
+			assert.Equal(t, tt.want, targets)
+		})
+	}
+}
+
+func Test_ParseBaseURL(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected string
+	}{
+		{"prow.ci.openshift.org", "https://prow.ci.openshift.org"},
+		{"http://prow.example.com:8080", "http://prow.example.com:8080"},
+		{"https://example.com/staging/prow", "https://example.com/staging/prow"},
+	}
+	for _, test := range tests {
+		u, err := ParseBaseURL(test.in)
+		assert.Nil(t, err)
+		assert.Equal(t, test.expected, u.String())
+	}
+
+	_, err := ParseBaseURL("ftp://prow.example.com")
+	assert.NotNil(t, err)
+}
+
+func Test_AnonymousDataProvider_GetData(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/staging/prowjobs.js", r.URL.Path)
+		assert.Equal(t, "decoration_config", r.URL.Query().Get("omit"))
+		w.Write([]byte(`{"items":[
+			{"metadata":{"labels":{"ci-operator.openshift.io/cloud":"vsphere"}},"spec":{"cluster":"vsphere"},"status":{"state":"pending"}},
+			{"metadata":{"labels":{"ci-operator.openshift.io/cloud":"vsphere"}},"spec":{"cluster":"vsphere"},"status":{"state":"success","completionTime":"2021-12-01T00:00:00Z"}},
+			{"metadata":{"labels":{"ci-operator.openshift.io/cloud":"vsphere"}},"spec":{"cluster":"build01"},"status":{"state":"pending"}},
+			{"spec":{"cluster":"vsphere"},"status":{"state":"pending"}}
+		]}`))
+	}))
+	defer server.Close()
+
+	provider, err := NewAnonymousDataProvider(server.URL+"/staging", "", time.Second, newDefaultSelector(t))
+	assert.Nil(t, err)
+
+	// Anonymously, every pending job on the vsphere cluster alias is selected
+	jobs, err := provider.GetData(context.TODO())
+	assert.Nil(t, err)
+	assert.Len(t, jobs, 2)
+}
+
+func Test_decodeProwJobs(t *testing.T) {
+	payload := `{"kind":"List","metadata":{"resourceVersion":"1"},"items":[
+		{"metadata":{"name":"a"},"spec":{"cluster":"vsphere"},"status":{"state":"pending"}},
+		{"metadata":{"name":"b"},"spec":{"cluster":"build01"},"status":{"state":"pending"}},
+		{"metadata":{"name":"c"},"spec":{"cluster":"vsphere"},"status":{"state":"success"}}
+	],"extra":[1,2,3]}`
+
+	jobs, err := decodeProwJobs(strings.NewReader(payload), func(job *prowapiv1.ProwJob) bool {
+		return job.ClusterAlias() == VSphereClusterAlias
+	})
+	assert.Nil(t, err)
+	assert.Len(t, jobs, 2)
+	assert.Equal(t, "a", jobs[0].Name)
+	assert.Equal(t, "c", jobs[1].Name)
+}
+
+func Test_decodeProwJobs_Bad(t *testing.T) {
+	_, err := decodeProwJobs(strings.NewReader(`[]`), func(job *prowapiv1.ProwJob) bool { return true })
+	assert.NotNil(t, err)
+
+	_, err = decodeProwJobs(strings.NewReader(`{"items":[{"spec":`), func(job *prowapiv1.ProwJob) bool { return true })
+	assert.NotNil(t, err)
+
+	// Skipped jobs still count towards the index of the bad one
+	_, err = decodeProwJobs(strings.NewReader(`{"items":[{},{},{"spec":1}]}`), func(job *prowapiv1.ProwJob) bool { return false })
+	assert.Contains(t, err.Error(), "error decoding prow job 2")
+}
+
+func Test_AnonymousDataProvider_GetData_Gzip(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "gzip", r.Header.Get("Accept-Encoding"))
+		w.Header().Set("Content-Encoding", "gzip")
+		gz := gzip.NewWriter(w)
+		gz.Write([]byte(`{"items":[{"metadata":{"labels":{"ci-operator.openshift.io/cloud":"vsphere"}},"spec":{"cluster":"vsphere"},"status":{"state":"pending"}}]}`))
+		gz.Close()
+	}))
+	defer server.Close()
+
+	provider, err := NewAnonymousDataProvider(server.URL, "", time.Second, newDefaultSelector(t))
+	assert.Nil(t, err)
+
+	jobs, err := provider.GetData(context.TODO())
+	assert.Nil(t, err)
+	assert.Len(t, jobs, 1)
+}
+
+// newDefaultSelector returns the default selector of anonymous Prow access.
+func newDefaultSelector(t *testing.T) *Selector {
+	selector, err := NewSelector(DefaultSelectorConfig(false))
+	assert.Nil(t, err)
+	return selector
+}
+
+func newSelectorTestJob(name string, cluster string, state prowapiv1.ProwJobState, jobType prowapiv1.ProwJobType) *prowapiv1.ProwJob {
+	return &prowapiv1.ProwJob{
+		ObjectMeta: metav1.ObjectMeta{
+			Labels: map[string]string{"ci-operator.openshift.io/cloud": "vsphere"},
+		},
+		Spec: prowapiv1.ProwJobSpec{
+			Job:     name,
+			Cluster: cluster,
+			Type:    jobType,
+		},
+		Status: prowapiv1.ProwJobStatus{State: state},
+	}
+}
+
+func Test_Selector_Default(t *testing.T) {
+	selector := newDefaultSelector(t)
+	now := time.Date(2022, 1, 1, 12, 0, 0, 0, time.UTC)
+	selector.now = func() time.Time { return now }
+	assert.Equal(t, "", selector.LabelSelector())
+
+	assert.True(t, selector.Matches(newSelectorTestJob("e2e", "vsphere", prowapiv1.PendingState, prowapiv1.PresubmitJob)))
+	assert.False(t, selector.Matches(newSelectorTestJob("e2e", "build01", prowapiv1.PendingState, prowapiv1.PresubmitJob)))
+	assert.False(t, selector.Matches(newSelectorTestJob("e2e", "vsphere", prowapiv1.TriggeredState, prowapiv1.PresubmitJob)))
+
+	unlabeled := newSelectorTestJob("e2e", "vsphere", prowapiv1.PendingState, prowapiv1.PresubmitJob)
+	unlabeled.Labels = nil
+	assert.True(t, selector.Matches(unlabeled))
+
+	// Recently finished jobs are selected for their final state
+	for _, state := range []prowapiv1.ProwJobState{prowapiv1.SuccessState, prowapiv1.FailureState, prowapiv1.AbortedState, prowapiv1.ErrorState} {
+		recent := newSelectorTestJob("e2e", "vsphere", state, prowapiv1.PresubmitJob)
+		recent.Status.CompletionTime = &metav1.Time{Time: now.Add(-time.Minute)}
+		assert.True(t, selector.Matches(recent), string(state))
+
+		old := newSelectorTestJob("e2e", "vsphere", state, prowapiv1.PresubmitJob)
+		old.Status.CompletionTime = &metav1.Time{Time: now.Add(-2 * time.Hour)}
+		assert.False(t, selector.Matches(old), string(state))
+	}
+}
+
+func Test_Selector_Default_Authenticated(t *testing.T) {
+	selector, err := NewSelector(DefaultSelectorConfig(true))
+	assert.Nil(t, err)
+	assert.Equal(t, VSphereLabelSelector, selector.LabelSelector())
+
+	// Labeled jobs are selected on any build cluster
+	assert.True(t, selector.Matches(newSelectorTestJob("e2e", "vsphere", prowapiv1.PendingState, prowapiv1.PresubmitJob)))
+	assert.True(t, selector.Matches(newSelectorTestJob("e2e", "build01", prowapiv1.PendingState, prowapiv1.PresubmitJob)))
+
+	unlabeled := newSelectorTestJob("e2e", "vsphere", prowapiv1.PendingState, prowapiv1.PresubmitJob)
+	unlabeled.Labels = nil
+	assert.False(t, selector.Matches(unlabeled))
+}
+
+func Test_Selector_Configured(t *testing.T) {
+	selector, err := NewSelector(SelectorConfig{
+		ClusterAliases: []string{"vsphere", "vsphere02"},
+		States:         []string{"triggered", "pending", "success"},
+		IncludeJobs:    []string{`-vsphere`},
+		ExcludeJobs:    []string{`-upgrade-`},
+		JobTypes:       []string{"presubmit", "periodic"},
+		MaxFinishedAge: time.Hour,
+	})
+	assert.Nil(t, err)
+	now := time.Date(2022, 1, 1, 12, 0, 0, 0, time.UTC)
+	selector.now = func() time.Time { return now }
+
+	assert.True(t, selector.Matches(newSelectorTestJob("e2e-vsphere", "vsphere02", prowapiv1.TriggeredState, prowapiv1.PeriodicJob)))
+	assert.False(t, selector.Matches(newSelectorTestJob("e2e-aws", "vsphere", prowapiv1.PendingState, prowapiv1.PresubmitJob)))
+	assert.False(t, selector.Matches(newSelectorTestJob("e2e-vsphere-upgrade-ovn", "vsphere", prowapiv1.PendingState, prowapiv1.PresubmitJob)))
+	assert.False(t, selector.Matches(newSelectorTestJob("e2e-vsphere", "vsphere", prowapiv1.PendingState, prowapiv1.PostsubmitJob)))
+	assert.False(t, selector.Matches(newSelectorTestJob("e2e-vsphere", "vsphere", prowapiv1.FailureState, prowapiv1.PresubmitJob)))
+
+	recent := newSelectorTestJob("e2e-vsphere", "vsphere", prowapiv1.SuccessState, prowapiv1.PresubmitJob)
+	recent.Status.CompletionTime = &metav1.Time{Time: now.Add(-time.Minute)}
+	assert.True(t, selector.Matches(recent))
+
+	old := newSelectorTestJob("e2e-vsphere", "vsphere", prowapiv1.SuccessState, prowapiv1.PresubmitJob)
+	old.Status.CompletionTime = &metav1.Time{Time: now.Add(-2 * time.Hour)}
+	assert.False(t, selector.Matches(old))
+}
+
+func Test_NewSelector_Bad(t *testing.T) {
+	_, err := NewSelector(SelectorConfig{States: []string{"running"}})
+	assert.NotNil(t, err)
+
+	_, err = NewSelector(SelectorConfig{JobTypes: []string{"nightly"}})
+	assert.NotNil(t, err)
+
+	_, err = NewSelector(SelectorConfig{IncludeJobs: []string{`(`}})
+	assert.NotNil(t, err)
+
+	_, err = NewSelector(SelectorConfig{LabelSelector: `a in (`})
+	assert.NotNil(t, err)
+}
+
+func Test_GetVariantFromProwJob(t *testing.T) {
+	tests := []struct {
+		name string
+		job  prowapiv1.ProwJob
+		want string
+	}{
+		{"none", prowapiv1.ProwJob{}, ""},
+		{
+			"label",
+			prowapiv1.ProwJob{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{VariantLabel: "nightly-4.10"}}},
+			"nightly-4.10",
+		},
+		{
+			"arg",
+			prowapiv1.ProwJob{Spec: prowapiv1.ProwJobSpec{PodSpec: &corev1.PodSpec{Containers: []corev1.Container{{Args: GoodArgs}}}}},
+			"nightly-4.7",
+		},
+		{
+			"separate arg",
+			prowapiv1.ProwJob{Spec: prowapiv1.ProwJobSpec{PodSpec: &corev1.PodSpec{Containers: []corev1.Container{{Args: []string{"--variant", "okd"}}}}}},
+			"okd",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, GetVariantFromProwJob(tt.job))
+		})
+	}
+}
+
+func Test_AnonymousDataProvider_GetData_Retry(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte(`{"items":[{"metadata":{"labels":{"ci-operator.openshift.io/cloud":"vsphere"}},"spec":{"cluster":"vsphere"},"status":{"state":"pending"}}]}`))
+	}))
+	defer server.Close()
+
+	provider, err := NewAnonymousDataProvider(server.URL, "", time.Second, newDefaultSelector(t))
+	assert.Nil(t, err)
+	var slept []time.Duration
+	provider.sleep = func(ctx context.Context, d time.Duration) error {
+		slept = append(slept, d)
+		return nil
+	}
+
+	jobs, err := provider.GetData(context.TODO())
+	assert.Nil(t, err)
+	assert.Len(t, jobs, 1)
+	assert.Equal(t, 3, attempts)
+	assert.Len(t, slept, 2)
+	assert.True(t, slept[1] >= defaultRetryDelay)
+	assert.Equal(t, float64(2), testutil.ToFloat64(provider.requests.WithLabelValues("502")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(provider.requests.WithLabelValues("200")))
+
+	// Prow stays down
+	attempts = -10
+	_, err = provider.GetData(context.TODO())
+	assert.NotNil(t, err)
+	assert.Equal(t, -10+defaultRetries+1, attempts)
+}
+
+func Test_AnonymousDataProvider_GetData_Canceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.TODO())
+	defer cancel()
+
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		cancel()
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	provider, err := NewAnonymousDataProvider(server.URL, "", time.Second, newDefaultSelector(t))
+	assert.Nil(t, err)
+	provider.retryDelay = time.Hour
+
+	// The scrape gave up, so Prow isn't retried
+	_, err = provider.GetData(ctx)
+	assert.True(t, errors.Is(err, context.Canceled))
+	assert.Equal(t, 1, attempts)
+}
+
+func Test_AnonymousDataProvider_GetData_NotModified(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(`{"items":[{"metadata":{"labels":{"ci-operator.openshift.io/cloud":"vsphere"}},"spec":{"cluster":"vsphere"},"status":{"state":"pending"}}]}`))
+	}))
+	defer server.Close()
+
+	provider, err := NewAnonymousDataProvider(server.URL, "", time.Second, newDefaultSelector(t))
+	assert.Nil(t, err)
+
+	jobs, err := provider.GetData(context.TODO())
+	assert.Nil(t, err)
+	assert.Len(t, jobs, 1)
+
+	jobs, err = provider.GetData(context.TODO())
+	assert.Nil(t, err)
+	assert.Len(t, jobs, 1)
+	assert.Equal(t, 2, requests)
+	assert.Equal(t, float64(1), testutil.ToFloat64(provider.requests.WithLabelValues("304")))
 }
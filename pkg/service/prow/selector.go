@@ -0,0 +1,169 @@
+package prow
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	prowapiv1 "k8s.io/test-infra/prow/apis/prowjobs/v1"
+)
+
+// SelectorConfig describes which ProwJobs are relevant. Empty fields match
+// every job.
+type SelectorConfig struct {
+	ClusterAliases []string
+	LabelSelector  string
+	States         []string
+	IncludeJobs    []string // Regexes, a job must match one of them
+	ExcludeJobs    []string // Regexes, a job must match none of them
+	JobTypes       []string
+
+	// Jobs in a finished state are only kept if they finished this recently.
+	// Zero keeps them all.
+	MaxFinishedAge time.Duration
+}
+
+// DefaultSelectorConfig selects pending vSphere jobs, and the ones that
+// finished within the last hour so their final state is known. Which jobs are
+// vSphere ones depends on how Prow is queried: anonymously, the jobs on the
+// vsphere cluster alias, and through the Kubernetes API (authenticated), the
+// jobs labeled with VSphereLabelSelector on any build cluster.
+func DefaultSelectorConfig(authenticated bool) SelectorConfig {
+	config := SelectorConfig{
+		States: []string{
+			string(prowapiv1.PendingState),
+			string(prowapiv1.SuccessState),
+			string(prowapiv1.FailureState),
+			string(prowapiv1.AbortedState),
+			string(prowapiv1.ErrorState),
+		},
+		MaxFinishedAge: time.Hour,
+	}
+	if authenticated {
+		config.LabelSelector = VSphereLabelSelector
+	} else {
+		config.ClusterAliases = []string{VSphereClusterAlias}
+	}
+	return config
+}
+
+// Selector applies a SelectorConfig to ProwJobs. Every DataProvider uses one,
+// so the same jobs are selected no matter where they come from.
+type Selector struct {
+	clusterAliases map[string]bool
+	labelSelector  labels.Selector
+	states         map[prowapiv1.ProwJobState]bool
+	includeJobs    []*regexp.Regexp
+	excludeJobs    []*regexp.Regexp
+	jobTypes       map[prowapiv1.ProwJobType]bool
+	maxFinishedAge time.Duration
+
+	rawLabelSelector string
+	now              func() time.Time
+}
+
+func NewSelector(config SelectorConfig) (*Selector, error) {
+	s := &Selector{
+		clusterAliases:   map[string]bool{},
+		states:           map[prowapiv1.ProwJobState]bool{},
+		jobTypes:         map[prowapiv1.ProwJobType]bool{},
+		maxFinishedAge:   config.MaxFinishedAge,
+		rawLabelSelector: config.LabelSelector,
+		now:              time.Now,
+	}
+
+	for _, alias := range config.ClusterAliases {
+		s.clusterAliases[alias] = true
+	}
+
+	var err error
+	s.labelSelector, err = labels.Parse(config.LabelSelector)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid prow job label selector")
+	}
+
+	for _, state := range config.States {
+		switch prowapiv1.ProwJobState(state) {
+		case prowapiv1.TriggeredState, prowapiv1.PendingState, prowapiv1.SuccessState,
+			prowapiv1.FailureState, prowapiv1.AbortedState, prowapiv1.ErrorState:
+			s.states[prowapiv1.ProwJobState(state)] = true
+		default:
+			return nil, fmt.Errorf("unknown prow job state: %s", state)
+		}
+	}
+
+	for _, jobType := range config.JobTypes {
+		switch prowapiv1.ProwJobType(jobType) {
+		case prowapiv1.PresubmitJob, prowapiv1.PostsubmitJob, prowapiv1.PeriodicJob, prowapiv1.BatchJob:
+			s.jobTypes[prowapiv1.ProwJobType(jobType)] = true
+		default:
+			return nil, fmt.Errorf("unknown prow job type: %s", jobType)
+		}
+	}
+
+	s.includeJobs, err = compileRegexes(config.IncludeJobs)
+	if err != nil {
+		return nil, err
+	}
+	s.excludeJobs, err = compileRegexes(config.ExcludeJobs)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func compileRegexes(exprs []string) ([]*regexp.Regexp, error) {
+	var regexes []*regexp.Regexp
+	for _, expr := range exprs {
+		r, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid prow job name regex %q", expr)
+		}
+		regexes = append(regexes, r)
+	}
+	return regexes, nil
+}
+
+// LabelSelector returns the label selector so it can be applied server-side.
+func (s *Selector) LabelSelector() string {
+	return s.rawLabelSelector
+}
+
+// Matches reports whether job is selected.
+func (s *Selector) Matches(job *prowapiv1.ProwJob) bool {
+	if len(s.clusterAliases) > 0 && !s.clusterAliases[job.ClusterAlias()] {
+		return false
+	}
+	if !s.labelSelector.Matches(labels.Set(job.Labels)) {
+		return false
+	}
+	if len(s.states) > 0 && !s.states[job.Status.State] {
+		return false
+	}
+	if len(s.jobTypes) > 0 && !s.jobTypes[job.Spec.Type] {
+		return false
+	}
+	if len(s.includeJobs) > 0 && !matchesAny(s.includeJobs, job.Spec.Job) {
+		return false
+	}
+	if matchesAny(s.excludeJobs, job.Spec.Job) {
+		return false
+	}
+	if s.maxFinishedAge > 0 && job.Complete() && job.Status.CompletionTime != nil &&
+		s.now().Sub(job.Status.CompletionTime.Time) > s.maxFinishedAge {
+		return false
+	}
+	return true
+}
+
+func matchesAny(regexes []*regexp.Regexp, s string) bool {
+	for _, r := range regexes {
+		if r.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,208 @@
+package vsphere
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/session/keepalive"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+const (
+	// KeepAliveInterval is how often an otherwise idle session is touched so
+	// vCenter doesn't expire it.
+	KeepAliveInterval = 5 * time.Minute
+)
+
+// Session is a long-lived vCenter session shared by every refresh. It is kept
+// alive in the background and transparently re-established when vCenter
+// expires it.
+type Session struct {
+	host      string
+	user      *url.Userinfo
+	userAgent string
+
+	// OnLogin, if set, is called after every login attempt with how long it
+	// took and whether it failed.
+	OnLogin func(duration time.Duration, err error)
+
+	// mu serializes use of the client. The login bookkeeping has its own lock
+	// so it can be read while a long running call holds the client.
+	mu     sync.Mutex
+	client *govmomi.Client
+
+	statsMu   sync.Mutex
+	loginTime time.Time
+	logins    int
+}
+
+func NewSession(host, user, passwd, userAgent string) *Session {
+	return &Session{
+		host:      host,
+		user:      url.UserPassword(user, passwd),
+		userAgent: userAgent,
+	}
+}
+
+// Login establishes the session if it isn't already.
+func (s *Session) Login(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.getClient(ctx)
+	return err
+}
+
+// Do calls f with a logged in client. If vCenter reports the session is no
+// longer authenticated, the session is re-established and f is retried once.
+func (s *Session) Do(ctx context.Context, f func(c *govmomi.Client) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, err := s.getClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = f(c)
+	if !IsNotAuthenticated(err) {
+		return err
+	}
+
+	log.Warnf("vSphere session for %s expired, logging in again", s.host)
+	s.dropClient(ctx)
+
+	c, err = s.getClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	return f(c)
+}
+
+// Logout ends the session, if any.
+func (s *Session) Logout(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.dropClient(ctx)
+}
+
+// Relogins returns how many times the session had to be re-established after
+// the first login.
+func (s *Session) Relogins() float64 {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+
+	if s.logins == 0 {
+		return 0
+	}
+	return float64(s.logins - 1)
+}
+
+// Age returns how long the current session has existed, or zero when there
+// is no session.
+func (s *Session) Age() time.Duration {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+
+	if s.loginTime.IsZero() {
+		return 0
+	}
+	return time.Since(s.loginTime)
+}
+
+func (s *Session) getClient(ctx context.Context) (*govmomi.Client, error) {
+	if s.client != nil {
+		return s.client, nil
+	}
+
+	start := time.Now()
+	c, err := s.login(ctx)
+	if s.OnLogin != nil {
+		s.OnLogin(time.Since(start), err)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debugf("logged in to vSphere %s", s.host)
+	s.client = c
+	s.statsMu.Lock()
+	s.loginTime = time.Now()
+	s.logins++
+	s.statsMu.Unlock()
+
+	return c, nil
+}
+
+func (s *Session) login(ctx context.Context) (*govmomi.Client, error) {
+	u, err := soap.ParseURL(fmt.Sprintf("https://%s", s.host))
+	if err != nil {
+		return nil, err
+	}
+
+	u.User = nil
+	c, err := govmomi.NewClient(ctx, u, true)
+	if err != nil {
+		return nil, err
+	}
+
+	// The keep alive handler starts with Login and stops with Logout, or once
+	// the session can no longer be kept alive.
+	c.Client.RoundTripper = keepalive.NewHandlerSOAP(c.Client.RoundTripper, KeepAliveInterval, nil)
+	c.UserAgent = s.userAgent
+	err = c.Login(ctx, s.user)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error logging in to vSphere %s", s.host)
+	}
+
+	return c, nil
+}
+
+func (s *Session) dropClient(ctx context.Context) {
+	if s.client == nil {
+		return
+	}
+
+	err := s.client.Logout(ctx)
+	if err != nil && !IsNotAuthenticated(err) {
+		log.Debug(errors.Wrapf(err, "error logging out of vSphere %s", s.host))
+	}
+	s.client = nil
+	s.statsMu.Lock()
+	s.loginTime = time.Time{}
+	s.statsMu.Unlock()
+}
+
+// IsNotAuthenticated reports whether err is vCenter telling us the session is
+// gone.
+func IsNotAuthenticated(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	err = errors.Cause(err)
+	var fault interface{}
+	switch {
+	case soap.IsSoapFault(err):
+		fault = soap.ToSoapFault(err).VimFault()
+	case soap.IsVimFault(err):
+		fault = soap.ToVimFault(err)
+	default:
+		return false
+	}
+
+	switch fault.(type) {
+	case types.NotAuthenticated, *types.NotAuthenticated:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,75 @@
+package vsphere
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/stretchr/testify/assert"
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/simulator"
+	"testing"
+	"time"
+)
+
+func Test_Session_Do_Relogin(t *testing.T) {
+	ctx := context.TODO()
+
+	model := simulator.VPX()
+	defer model.Remove()
+	err := model.Create()
+	assert.Nil(t, err)
+	// Sessions always log in over https
+	model.Service.TLS = new(tls.Config)
+	server := model.Service.NewServer()
+	defer server.Close()
+
+	password, _ := server.URL.User.Password()
+	s := NewSession(server.URL.Host, server.URL.User.Username(), password, "test")
+	logins := 0
+	s.OnLogin = func(duration time.Duration, err error) {
+		assert.Nil(t, err)
+		logins++
+	}
+	defer s.Logout(ctx)
+
+	err = s.Login(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, float64(0), s.Relogins())
+
+	var key string
+	err = s.Do(ctx, func(c *govmomi.Client) error {
+		us, err := session.NewManager(c.Client).UserSession(ctx)
+		if err != nil {
+			return err
+		}
+		key = us.Key
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.NotEmpty(t, key)
+
+	time.Sleep(50 * time.Millisecond)
+	age := s.Age()
+	assert.True(t, age >= 50*time.Millisecond)
+
+	// vCenter ends the session behind our back
+	admin, err := govmomi.NewClient(ctx, server.URL, true)
+	assert.Nil(t, err)
+	defer admin.Logout(ctx)
+	err = session.NewManager(admin.Client).TerminateSession(ctx, []string{key})
+	assert.Nil(t, err)
+
+	calls := 0
+	var v *VSphereUsers
+	err = s.Do(ctx, func(c *govmomi.Client) (err error) {
+		calls++
+		v, err = GetVsphereData(ctx, c)
+		return err
+	})
+	assert.Nil(t, err)
+	assert.NotNil(t, v)
+	assert.Equal(t, 2, calls)
+	assert.Equal(t, 2, logins)
+	assert.Equal(t, float64(1), s.Relogins())
+	assert.True(t, s.Age() < age)
+}
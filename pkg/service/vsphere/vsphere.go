@@ -6,8 +6,10 @@ import (
 	log "github.com/sirupsen/logrus"
 	"github.com/vmware/govmomi"
 	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/vim25/methods"
 	"github.com/vmware/govmomi/vim25/mo"
 	"regexp"
+	"time"
 )
 
 var (
@@ -16,6 +18,27 @@ var (
 
 type VSphereUsers struct {
 	Mappings map[string]map[string]float64 // username => { user agent => count }
+	Sessions []UserSession
+	Now      time.Time // vCenter's clock when the sessions were listed
+}
+
+// UserSession is a single session on vCenter.
+type UserSession struct {
+	Username       string // Without domain
+	UserAgent      string
+	LoginTime      time.Time
+	LastActiveTime time.Time
+	IPAddress      string // Client address as seen by vCenter
+}
+
+// Age returns how long the session has existed at the time it was listed.
+func (s UserSession) Age(now time.Time) time.Duration {
+	return now.Sub(s.LoginTime)
+}
+
+// Idle returns how long the session had been idle at the time it was listed.
+func (s UserSession) Idle(now time.Time) time.Duration {
+	return now.Sub(s.LastActiveTime)
 }
 
 func (v *VSphereUsers) ForEach(f func(username string, userAgents map[string]float64)) {
@@ -38,6 +61,17 @@ func (v *VSphereUsers) addMapping(username string, userAgent string) {
 	userAgentMap[userAgent] = userAgentMap[userAgent] + 1 // Increment counter
 }
 
+// Total returns the number of sessions across all users.
+func (v *VSphereUsers) Total() float64 {
+	var total float64
+	for _, userAgentMap := range v.Mappings {
+		for _, count := range userAgentMap {
+			total += count
+		}
+	}
+	return total
+}
+
 func (v *VSphereUsers) GetUserAgentsForUser(username string) map[string]float64 {
 	log.Debugf("checking sessions for user %s", username)
 	userAgents, ok := v.Mappings[username]
@@ -47,26 +81,40 @@ func (v *VSphereUsers) GetUserAgentsForUser(username string) map[string]float64
 	return userAgents
 }
 
-func GetVsphereData(vmClient *govmomi.Client) (*VSphereUsers, error) {
+func GetVsphereData(ctx context.Context, vmClient *govmomi.Client) (*VSphereUsers, error) {
 	v := &VSphereUsers{
 		Mappings: map[string]map[string]float64{},
 	}
 
-	m, err := getSessionManager(vmClient, context.TODO())
+	m, err := getSessionManager(ctx, vmClient)
 	if err != nil {
 		return nil, errors.Wrap(err, "error getting session manager")
 	}
 
+	// Session times are compared against vCenter's clock, not ours
+	now, err := methods.GetCurrentTime(ctx, vmClient.Client)
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting vcenter time")
+	}
+	v.Now = *now
+
 	log.Debugf("Found %d user sessions", len(m.SessionList))
 	for _,s := range m.SessionList {
 		v.addMapping(s.UserName, s.UserAgent)
+		v.Sessions = append(v.Sessions, UserSession{
+			Username:       StripDomain(s.UserName),
+			UserAgent:      s.UserAgent,
+			LoginTime:      s.LoginTime,
+			LastActiveTime: s.LastActiveTime,
+			IPAddress:      s.IpAddress,
+		})
 	}
 
 	return v, nil
 }
 
 // From https://github.com/vmware/govmomi/blob/master/govc/session/ls.go
-func getSessionManager(vmClient *govmomi.Client, ctx context.Context) (*mo.SessionManager, error) {
+func getSessionManager(ctx context.Context, vmClient *govmomi.Client) (*mo.SessionManager, error) {
 	var m mo.SessionManager
 	var props []string
 	c := vmClient.Client
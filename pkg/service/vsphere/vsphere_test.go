@@ -1,7 +1,10 @@
 package vsphere
 
 import (
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
 	"testing"
 )
 
@@ -16,3 +19,24 @@ func Test_StripDomain_B(t *testing.T) {
 	p := StripDomain("VSPHERE.LOCAL\\user")
 	assert.Equal(t, expected, p)
 }
+
+func Test_IsNotAuthenticated_Fault(t *testing.T) {
+	err := errors.Wrap(soap.WrapVimFault(&types.NotAuthenticated{}), "failed scraping vsphere")
+	assert.True(t, IsNotAuthenticated(err))
+}
+
+func Test_IsNotAuthenticated_Other(t *testing.T) {
+	assert.False(t, IsNotAuthenticated(soap.WrapVimFault(&types.InvalidLogin{})))
+	assert.False(t, IsNotAuthenticated(errors.New("connection refused")))
+	assert.False(t, IsNotAuthenticated(nil))
+}
+
+func Test_VSphereUsers_Total(t *testing.T) {
+	v := &VSphereUsers{
+		Mappings: map[string]map[string]float64{},
+	}
+	v.addMapping("user@vsphere.local", "govc")
+	v.addMapping("user@vsphere.local", "govc")
+	v.addMapping("VSPHERE.LOCAL\\other", "terraform")
+	assert.Equal(t, float64(3), v.Total())
+}